@@ -1,105 +1,128 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"flag"
 	"fmt"
-	stdio "io"
-	"io/ioutil"
 	"log"
-	"net"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/telendt/fmaze/event"
-	"github.com/telendt/fmaze/io"
+	"github.com/telendt/fmaze/deadletter"
 	"github.com/telendt/fmaze/router"
+	"github.com/telendt/fmaze/server"
+	"github.com/telendt/fmaze/wal"
 )
 
-var nilTime time.Time
-
 func main() {
+	if err := run(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+// run runs the server until it's interrupted, so that deferred calls
+// closing dead letter file and write-ahead log are made when it fails too.
+func run() error {
+	opts := server.DefaultOptions
 	var (
-		authTimeout       = flag.Duration("auth-timeout", 1*time.Second, "Client authentication timeout")
-		clientsListenAddr = flag.String("clients-listen", ":9099", "User clients listen address")
-		eventsCap         = flag.Int("events-capacity", 100000, "Capacity of unordered events store")
-		flushInterval     = flag.Duration("flush-interval", 10*time.Second, "Write flush interval")
-		msgBacklog        = flag.Int("msg-backlog", 10, "Client message backlog")
-		noBackpressure    = flag.Bool("no-backpressure", false, "Disable client write backpressure")
-		noReset           = flag.Bool("no-reset", false, "Don't reset internal state when event source disconnects")
-		readBufSize       = flag.Int("read-buffer", 4096, "Read buffer size in bytes")
-		sourceListenAddr  = flag.String("event-source-listen", ":9090", "Event source listen address")
-		startSeq          = flag.Int64("start-sequence", 1, "Sequence start number")
-		useWritev         = flag.Bool("use-writev", false, "Try to use writev instead of write syscall")
-		writeBufSize      = flag.Int("write-buffer", 4096, "Write buffer size in bytes")
+		graph             = flag.String("graph", "sparse", "Follow graph backend (sparse or dense)")
+		deadLetterFile    = flag.String("dead-letter-file", "", "File to record rejected event lines in")
+		deadLetterMaxSize = flag.Int64("dead-letter-max-size", 10<<20, "Dead letter file size in bytes that triggers its rotation")
+		deadLetterBackups = flag.Int("dead-letter-backups", 3, "Number of rotated dead letter files to keep")
+		walDir            = flag.String("wal-dir", "", "Directory of write-ahead log of events (disabled if empty)")
+		walOpts           = wal.DefaultOptions
 	)
+	flag.StringVar(&opts.AdminListenAddr, "admin-listen", opts.AdminListenAddr, "Admin HTTP listen address serving /metrics and /snapshot (disabled if empty)")
+	flag.DurationVar(&opts.AuthTimeout, "auth-timeout", opts.AuthTimeout, "Client authentication timeout")
+	flag.StringVar(&opts.ClientsListenAddr, "clients-listen", opts.ClientsListenAddr, "User clients listen address")
+	flag.DurationVar(&opts.DrainTimeout, "drain-timeout", opts.DrainTimeout, "Maximum time to deliver pending messages on shutdown")
+	flag.IntVar(&opts.EventsCapacity, "events-capacity", opts.EventsCapacity, "Maximum capacity of unordered events store")
+	flag.IntVar(&opts.EventsInitialCapacity, "events-initial-capacity", opts.EventsInitialCapacity, "Initial capacity of unordered events store")
+	flag.IntVar(&opts.FanoutWorkers, "fanout-workers", opts.FanoutWorkers, "Number of goroutines sending messages to clients, so that slow clients don't hold up events (0 sends while dispatching)")
+	flag.IntVar(&opts.FanoutQueueSize, "fanout-queue-size", opts.FanoutQueueSize, "Maximum number of messages queued for every fan-out worker")
+	flag.DurationVar(&opts.FlushInterval, "flush-interval", opts.FlushInterval, "Write flush interval")
+	flag.DurationVar(&opts.GapTimeout, "gap-timeout", opts.GapTimeout, "Time to wait for a missing event before skipping it (0 waits forever)")
+	flag.IntVar(&opts.GapMaxBuffered, "gap-max-buffered", opts.GapMaxBuffered, "Number of events waiting for a missing one before it's skipped (0 means no limit)")
+	flag.IntVar(&opts.HistorySize, "history-size", opts.HistorySize, "Number of latest messages kept for every user for resuming clients (0 disables history)")
+	flag.IntVar(&opts.HistoryMaxUsers, "history-max-users", opts.HistoryMaxUsers, "Maximum number of users whose messages are kept in history (0 means no limit)")
+	flag.IntVar(&opts.MsgBacklog, "msg-backlog", opts.MsgBacklog, "Client message backlog")
+	flag.BoolVar(&opts.NamedSources, "named-sources", opts.NamedSources, "Make event sources send \"name[|startSeq]\" handshake and number events of every name independently")
+	flag.BoolVar(&opts.NoBackpressure, "no-backpressure", opts.NoBackpressure, "Disable client write backpressure")
+	flag.BoolVar(&opts.NoReset, "no-reset", opts.NoReset, "Don't reset internal state when event source disconnects")
+	flag.BoolVar(&opts.OfflineStore, "offline-store", opts.OfflineStore, "Store messages for disconnected users until they connect")
+	flag.IntVar(&opts.OfflineLimits.MaxMessages, "offline-max-messages", opts.OfflineLimits.MaxMessages, "Maximum number of messages stored for a disconnected user (0 means no limit)")
+	flag.IntVar(&opts.OfflineLimits.MaxBytes, "offline-max-bytes", opts.OfflineLimits.MaxBytes, "Maximum size in bytes of messages stored for a disconnected user (0 means no limit)")
+	flag.DurationVar(&opts.OfflineLimits.MaxAge, "offline-max-age", opts.OfflineLimits.MaxAge, "Maximum time a message is stored for a disconnected user (0 means no limit)")
+	flag.IntVar(&opts.OfflineLimits.MaxUsers, "offline-max-users", opts.OfflineLimits.MaxUsers, "Maximum number of disconnected users with stored messages (0 means no limit)")
+	flag.IntVar(&opts.ReadBufferSize, "read-buffer", opts.ReadBufferSize, "Read buffer size in bytes")
+	flag.IntVar(&opts.RouterShards, "router-shards", opts.RouterShards, "Number of router shards, each with its own lock and graphs (GOMAXPROCS if 0, 1 with dense graph)")
+	flag.StringVar(&opts.EventSourceListenAddr, "event-source-listen", opts.EventSourceListenAddr, "Event source listen address")
+	flag.IntVar(&opts.SendWorkers, "send-workers", opts.SendWorkers, "Number of goroutines sending messages to clients that aren't ready to receive them (GOMAXPROCS if 0, none if negative)")
+	flag.Var(&opts.SlowConsumer.Overflow, "slow-consumer", "Handling of messages to clients that are full with -no-backpressure (`policy`: drop-newest, drop-oldest or disconnect)")
+	flag.Int64Var(&opts.SlowConsumer.MaxDrops, "slow-consumer-max-drops", opts.SlowConsumer.MaxDrops, "Number of messages dropped since client got full that makes disconnect policy disconnect it (0 means no limit)")
+	flag.DurationVar(&opts.SlowConsumer.MaxFullTime, "slow-consumer-max-full", opts.SlowConsumer.MaxFullTime, "Time since client got full that makes disconnect policy disconnect it (0 means no limit, with no limits it's disconnected on the first drop)")
+	flag.StringVar(&opts.SnapshotFile, "snapshot-file", opts.SnapshotFile, "File to write follow graph snapshots to and restore them from (disabled if empty)")
+	flag.DurationVar(&opts.SnapshotInterval, "snapshot-interval", opts.SnapshotInterval, "Follow graph snapshot interval (0 disables periodic snapshots)")
+	flag.BoolVar(&opts.SourceBackpressure, "source-backpressure", opts.SourceBackpressure, "Stop reading from event source while unordered events store is full")
+	flag.Int64Var(&opts.StartSequence, "start-sequence", opts.StartSequence, "Sequence start number")
+	flag.BoolVar(&opts.UseWritev, "use-writev", opts.UseWritev, "Try to use writev instead of write syscall")
+	flag.IntVar(&opts.WriteBufferSize, "write-buffer", opts.WriteBufferSize, "Write buffer size in bytes")
+	flag.Int64Var(&walOpts.SegmentSize, "wal-segment-size", walOpts.SegmentSize, "Write-ahead log segment file size in bytes")
+	flag.Var(&walOpts.Sync, "wal-sync", "Write-ahead log sync `policy`: always, interval or never (default interval)")
+	flag.DurationVar(&walOpts.SyncInterval, "wal-sync-interval", walOpts.SyncInterval, "Write-ahead log sync interval of interval sync policy")
+	policies := make(map[server.ErrorClass]*server.ErrorPolicy)
+	for _, class := range server.ErrorClasses {
+		p := new(server.ErrorPolicy)
+		flag.Var(p, "on-"+class.String(), fmt.Sprintf("Handling of %s event lines (`policy`: disconnect, skip-and-log, skip-silently or dead-letter)", class))
+		policies[class] = p
+	}
 	flag.Parse()
 
-	rt := router.New(!*noBackpressure)
-
-	cl, err := net.Listen("tcp", *clientsListenAddr)
-	if err != nil {
-		log.Fatal(err)
+	newGraph, ok := router.Graphs[*graph]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown graph backend %q\n", *graph)
+		flag.Usage()
+		os.Exit(2)
 	}
-	go func() {
-		forwarder := io.NewMaxLatencyForwarder(*writeBufSize, *flushInterval, *useWritev)
-		for {
-			conn, err := cl.Accept()
-			if err != nil {
-				log.Fatal(err)
-			}
-			go func() {
-				defer conn.Close()
-				var userID int
-				conn.SetReadDeadline(time.Now().Add(*authTimeout))
-				if _, err := fmt.Fscanln(conn, &userID); err != nil {
-					return
-				}
-				c := make(chan []byte, *msgBacklog)
-				unsubscribe, done, _ := rt.Subscribe(userID, c)
-				defer unsubscribe()
-				go func() {
-					conn.SetReadDeadline(nilTime)
-					_, _ = stdio.Copy(ioutil.Discard, conn)
-					unsubscribe()
-					close(c)
-				}()
-				forwarder.Forward(done, conn, c)
-			}()
-		}
-	}()
-
-	dispatcher := event.NewDispatcher(rt, *startSeq, *eventsCap)
-	ln, err := net.Listen("tcp", *sourceListenAddr)
-	if err != nil {
-		log.Fatal(err)
+	if *graph == "dense" && opts.RouterShards == 0 {
+		// every shard would take memory of the whole adjacency matrix
+		opts.RouterShards = 1
 	}
-	for {
-		conn, err := ln.Accept()
+	opts.Graph = newGraph
+	if *deadLetterFile != "" {
+		dl, err := deadletter.Open(*deadLetterFile, *deadLetterMaxSize, *deadLetterBackups)
 		if err != nil {
-			log.Fatal(err)
-		}
-		r := bufio.NewReaderSize(conn, *readBufSize)
-		for {
-			line, err := r.ReadBytes('\n')
-			if err != nil {
-				conn.Close()
-				break
-			}
-			event, err := event.Parse(line)
-			if err != nil {
-				log.Printf("%s: %q\n", err.Error(), line)
-				conn.Close()
-				break
-			}
-			if err := dispatcher.Dispatch(event); err != nil {
-				log.Printf("%s: %q\n", err.Error(), line)
-				conn.Close()
-				break
-			}
+			return err
 		}
-		if !*noReset {
-			dispatcher.Reset()
-			rt.Reset()
+		defer dl.Close()
+		opts.DeadLetter = dl
+	}
+	if *walDir != "" {
+		l, err := wal.Open(*walDir, walOpts)
+		if err != nil {
+			return err
 		}
+		defer l.Close()
+		opts.WAL = l
+	}
+	opts.ErrorPolicies = make(map[server.ErrorClass]server.ErrorPolicy)
+	for class, p := range policies {
+		opts.ErrorPolicies[class] = *p
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Printf("%s received, shutting down\n", <-sigc)
+		cancel()
+	}()
+
+	srv := server.New(opts)
+	err := srv.Run(ctx)
+	stats := srv.Stats()
+	log.Printf("%d messages delivered, %d dropped\n", stats.Delivered, stats.Dropped)
+	return err
 }
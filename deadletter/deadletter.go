@@ -0,0 +1,143 @@
+// Package deadletter records rejected event lines in a rotating file.
+package deadletter
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/telendt/fmaze/event"
+)
+
+// File appends rejected event lines to a file, one entry per line:
+//
+//	Timestamp Source ErrorType "Error" "Payload"
+//
+// where Error and Payload are Go-quoted. When the file grows over maxSize
+// bytes it's rotated: path is renamed to path.1, path.1 to path.2 and so on,
+// up to maxBackups files. File is safe for concurrent use.
+type File struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+	closed     bool
+	now        func() time.Time
+}
+
+// Open opens (or creates) dead letter file at path.
+// maxSize of 0 disables rotation.
+func Open(path string, maxSize int64, maxBackups int) (*File, error) {
+	d := &File{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		now:        time.Now,
+	}
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *File) open() error {
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	d.f = f
+	d.size = fi.Size()
+	return nil
+}
+
+func (d *File) rotate() error {
+	if err := d.f.Close(); err != nil {
+		return err
+	}
+	d.f = nil
+	if d.maxBackups > 0 {
+		for i := d.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", d.path, i), fmt.Sprintf("%s.%d", d.path, i+1))
+		}
+		if err := os.Rename(d.path, d.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(d.path); err != nil {
+		return err
+	}
+	return d.open()
+}
+
+// errorType returns name of event error type (or value for sentinel errors).
+func errorType(err error) string {
+	switch err {
+	case event.ErrBadFormat:
+		return "ErrBadFormat"
+	case event.ErrSeqTooSmall:
+		return "ErrSeqTooSmall"
+	case event.ErrSeqTooLarge:
+		return "ErrSeqTooLarge"
+	case event.ErrSeqDuplicate:
+		return "ErrSeqDuplicate"
+	}
+	switch err.(type) {
+	case *event.UnknownTypeError:
+		return "UnknownTypeError"
+	case *event.BadArgumentsNumberError:
+		return "BadArgumentsNumberError"
+	}
+	return fmt.Sprintf("%T", err)
+}
+
+// DeadLetter appends event line rejected with err, read from source.
+// Write errors are logged.
+func (d *File) DeadLetter(source string, line []byte, err error) {
+	entry := fmt.Sprintf("%s %s %s %q %q\n",
+		d.now().UTC().Format(time.RFC3339Nano), source, errorType(err), err.Error(), line)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	if d.f == nil {
+		// previous rotation failed
+		if err := d.open(); err != nil {
+			log.Printf("deadletter: %s\n", err.Error())
+			return
+		}
+	}
+	if d.maxSize > 0 && d.size > 0 && d.size+int64(len(entry)) > d.maxSize {
+		if err := d.rotate(); err != nil {
+			log.Printf("deadletter: %s\n", err.Error())
+			return
+		}
+	}
+	n, err := d.f.WriteString(entry)
+	d.size += int64(n)
+	if err != nil {
+		log.Printf("deadletter: %s\n", err.Error())
+	}
+}
+
+// Close closes the file, entries added afterwards are discarded.
+func (d *File) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
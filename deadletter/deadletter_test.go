@@ -0,0 +1,55 @@
+package deadletter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/telendt/fmaze/event"
+)
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestFileDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead.log")
+
+	d, err := Open(path, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.now = func() time.Time { return time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	d.DeadLetter("127.0.0.1:1234", []byte("1|X\n"), &event.UnknownTypeError{Type: 'X'})
+	want := "2017-01-02T03:04:05Z 127.0.0.1:1234 UnknownTypeError \"events: unknown type 'X'\" \"1|X\\n\"\n"
+	if have := readFile(t, path); have != want {
+		t.Errorf("File content %q, want %q", have, want)
+	}
+
+	d.DeadLetter("127.0.0.1:1234", []byte("\xff\n"), event.ErrBadFormat)   // rotates
+	d.DeadLetter("127.0.0.1:1234", []byte("1|B\n"), event.ErrSeqDuplicate) // rotates
+	d.DeadLetter("127.0.0.1:1234", []byte("1|B\n"), event.ErrSeqTooSmall)  // rotates, drops oldest
+	if have := readFile(t, path); !strings.Contains(have, " ErrSeqTooSmall ") {
+		t.Errorf("Current file should contain the last entry, have %q", have)
+	}
+	if have := readFile(t, path+".1"); !strings.Contains(have, " ErrSeqDuplicate ") {
+		t.Errorf("Backup file should contain previous entry, have %q", have)
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Error("Only one backup file should be kept")
+	}
+}
@@ -2,6 +2,9 @@ package event
 
 import (
 	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -18,54 +21,372 @@ var (
 	ErrSeqDuplicate = errors.New("orderer: event.Seq duplicate found")
 )
 
+// GapPolicy defines when Dispatcher gives up waiting for missing events.
+// Zero value never skips any gap.
+type GapPolicy struct {
+	// Timeout is the maximum time a gap can stay open
+	// while there are events waiting behind it (0 means no limit).
+	Timeout time.Duration
+
+	// MaxBuffered is the maximum number of events waiting
+	// behind a gap (0 means no limit).
+	MaxBuffered int
+
+	// OnSkip, if not nil, is called with the range of skipped sequence numbers.
+	// It's called with Dispatcher locked, so it must not call its methods.
+	OnSkip func(from, to int64)
+}
+
+// DefaultInitialCapacity is the default initial capacity of Dispatcher's
+// unordered events store.
+const DefaultInitialCapacity = 64
+
+// DispatcherOption configures Dispatcher.
+type DispatcherOption func(*Dispatcher)
+
+// WithGapPolicy makes Dispatcher skip gaps according to policy p.
+func WithGapPolicy(p GapPolicy) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.gapPolicy = p
+	}
+}
+
+// WithInitialCapacity sets initial capacity of Dispatcher's unordered events store.
+// Store grows up to Dispatcher's capacity when needed and shrinks back by half
+// once it's stayed empty for as many dispatched events as its size.
+func WithInitialCapacity(n int) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.minCapacity = n
+	}
+}
+
 // Dispatcher orders events and triggers their actions once they are in order.
+// It's safe for concurrent use.
 type Dispatcher struct {
+	// copies of next expected sequence number and number of buffered events
+	// that can be read (atomically) without waiting for triggered actions
+	seq, nBuffered int64
+
+	mu           sync.Mutex
+	initialIndex int64
 	startIndex   int64
 	currentIndex int64
 	actions      Actions
 	triggers     []ActionsTrigger
+	minCapacity  int
+	maxCapacity  int
+
+	// number of events waiting for a gap to close
+	buffered int
+	// sequence numbers of events waiting in DispatchWait
+	waiting []int64
+	// number of events dispatched since store got empty
+	idle int
+	// signaled when currentIndex moves forward
+	advanced *sync.Cond
+
+	gapPolicy GapPolicy
+	gapTimer  *time.Timer
+	// currentIndex of the gap watched by gapTimer
+	gapIndex int64
 }
 
 // Dispatch inserts event e into the right slot and triggers actions of the ordered slice.
 func (d *Dispatcher) Dispatch(e Event) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dispatch(e)
+}
+
+// DispatchWait is like Dispatch, but instead of returning ErrSeqTooLarge
+// it waits until event e fits into unordered events store, which happens
+// when missing events are dispatched by other goroutines or skipped by gap policy.
+// Waiting event counts towards gap policy limits like the buffered ones.
+// It returns ErrSeqTooLarge if done is closed before that.
+func (d *Dispatcher) DispatchWait(done <-chan struct{}, e Event) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tooLarge(e.Seq) && !d.wait(done, e.Seq) {
+		return ErrSeqTooLarge
+	}
+	return d.dispatch(e)
+}
+
+// wait waits until event with sequence number seq fits into unordered events
+// store. It reports false if done is closed before that.
+func (d *Dispatcher) wait(done <-chan struct{}, seq int64) bool {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-done:
+			d.mu.Lock()
+			d.advanced.Broadcast()
+			d.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	d.waiting = append(d.waiting, seq)
+	defer func() {
+		for i, s := range d.waiting {
+			if s == seq {
+				d.waiting = append(d.waiting[:i], d.waiting[i+1:]...)
+				break
+			}
+		}
+	}()
+	d.checkGap()
+	d.watchGap()
+	for d.tooLarge(seq) {
+		select {
+		case <-done:
+			return false
+		default:
+		}
+		d.advanced.Wait()
+	}
+	return true
+}
+
+func (d *Dispatcher) tooLarge(seq int64) bool {
+	return seq-d.startIndex >= d.currentIndex+int64(d.maxCapacity)
+}
+
+func (d *Dispatcher) dispatch(e Event) error {
 	i := e.Seq - d.startIndex
 	if i < d.currentIndex {
 		return ErrSeqTooSmall
 	}
-	l := int64(len(d.triggers))
-	if i >= d.currentIndex+l {
+	if d.tooLarge(e.Seq) {
 		return ErrSeqTooLarge
 	}
+	if i >= d.currentIndex+int64(len(d.triggers)) {
+		d.grow(int(i - d.currentIndex + 1))
+	}
+	l := int64(len(d.triggers))
 
 	if d.triggers[i%l] != nil {
 		return ErrSeqDuplicate
 	}
 	d.triggers[i%l] = e
+	d.buffered++
+	d.advance()
+	d.checkGap()
+	d.shrink()
+	d.watchGap()
+	return nil
+}
+
+// pending returns number of events waiting for a gap to close,
+// both buffered and too large to be buffered yet.
+func (d *Dispatcher) pending() int {
+	n := d.buffered
+	for _, seq := range d.waiting {
+		if d.tooLarge(seq) {
+			n++
+		}
+	}
+	return n
+}
+
+// checkGap skips gaps while there are more events pending than gap policy allows.
+func (d *Dispatcher) checkGap() {
+	for max := d.gapPolicy.MaxBuffered; max > 0 && d.pending() > max; {
+		if !d.skipGap() {
+			break
+		}
+	}
+}
+
+// shrink halves the store size (but no less than minCapacity)
+// once it's stayed empty for as many events as its size.
+func (d *Dispatcher) shrink() {
+	if d.buffered > 0 || len(d.triggers) <= d.minCapacity {
+		d.idle = 0
+		return
+	}
+	if d.idle++; d.idle < len(d.triggers) {
+		return
+	}
+	size := len(d.triggers) / 2
+	if size < d.minCapacity {
+		size = d.minCapacity
+	}
+	d.triggers = make([]ActionsTrigger, size)
+	d.idle = 0
+}
+
+// grow doubles the store size until it fits n events (but no more than maxCapacity).
+func (d *Dispatcher) grow(n int) {
+	size := len(d.triggers)
+	for size < n {
+		size *= 2
+	}
+	if size > d.maxCapacity {
+		size = d.maxCapacity
+	}
+	triggers := make([]ActionsTrigger, size)
+	l, newL := int64(len(d.triggers)), int64(size)
+	for i := d.currentIndex; i < d.currentIndex+l; i++ {
+		triggers[i%newL] = d.triggers[i%l]
+	}
+	d.triggers = triggers
+}
+
+// advance triggers actions of all the ordered events.
+func (d *Dispatcher) advance() {
+	l := int64(len(d.triggers))
 	for {
 		t := d.triggers[d.currentIndex%l]
 		if t == nil {
+			d.publish()
+			d.advanced.Broadcast()
 			break
 		}
+		if seqr, ok := d.actions.(Sequencer); ok {
+			seqr.SetSeq(d.startIndex + d.currentIndex)
+		}
 		t.Trigger(d.actions)
 		d.triggers[d.currentIndex%l] = nil
 		d.currentIndex++
+		d.buffered--
 	}
-	return nil
+}
+
+// skipGap skips missing events up to the first buffered one or, if there are
+// none, up to the first one waiting in DispatchWait that's too large to be buffered.
+// It reports whether any events have been skipped.
+func (d *Dispatcher) skipGap() bool {
+	from := d.currentIndex
+	if d.buffered > 0 {
+		l := int64(len(d.triggers))
+		for d.triggers[d.currentIndex%l] == nil {
+			d.currentIndex++
+		}
+	} else {
+		if len(d.waiting) == 0 {
+			return false
+		}
+		first := d.waiting[0]
+		for _, seq := range d.waiting[1:] {
+			if seq < first {
+				first = seq
+			}
+		}
+		if !d.tooLarge(first) {
+			return false // it's about to be buffered
+		}
+		// store is empty, so no slots need to be cleared
+		d.currentIndex = first - d.startIndex
+	}
+	if d.gapPolicy.OnSkip != nil {
+		d.gapPolicy.OnSkip(from+d.startIndex, d.currentIndex-1+d.startIndex)
+	}
+	d.advance()
+	return true
+}
+
+// watchGap (re)starts gap timer when a new gap opens and stops it once it's closed.
+func (d *Dispatcher) watchGap() {
+	if d.gapPolicy.Timeout <= 0 {
+		return
+	}
+	if d.gapTimer != nil {
+		if d.pending() > 0 && d.gapIndex == d.currentIndex {
+			return // still the same gap
+		}
+		d.gapTimer.Stop()
+		d.gapTimer = nil
+	}
+	if d.pending() == 0 {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d.gapPolicy.Timeout, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.gapTimer != t {
+			return // gap closed in the meantime
+		}
+		d.gapTimer = nil
+		d.skipGap()
+		d.watchGap()
+	})
+	d.gapTimer = t
+	d.gapIndex = d.currentIndex
+}
+
+// Seq returns sequence number of the next expected event.
+func (d *Dispatcher) Seq() int64 {
+	return atomic.LoadInt64(&d.seq)
+}
+
+// Buffered returns number of unordered events waiting for missing ones.
+func (d *Dispatcher) Buffered() int {
+	return int(atomic.LoadInt64(&d.nBuffered))
+}
+
+// publish updates values returned by Seq and Buffered methods.
+func (d *Dispatcher) publish() {
+	atomic.StoreInt64(&d.seq, d.startIndex+d.currentIndex)
+	atomic.StoreInt64(&d.nBuffered, int64(d.buffered))
+}
+
+// Do calls f with sequence number of the next expected event, while no actions
+// are being triggered, so that f can see state changed by all the previous events
+// and none of the next ones. It's called with Dispatcher locked,
+// so it must not call its methods.
+func (d *Dispatcher) Do(f func(seq int64)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f(d.startIndex + d.currentIndex)
 }
 
 // Reset resets dispatcher's internal state.
 func (d *Dispatcher) Reset() {
-	for i := range d.triggers {
-		d.triggers[i] = nil
-	}
+	d.ResetTo(d.initialIndex)
+}
+
+// ResetTo resets dispatcher's internal state like Reset,
+// but makes it expect event with sequence number seq next.
+// Subsequent Reset calls make it expect the initial sequence number again.
+func (d *Dispatcher) ResetTo(seq int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.triggers = make([]ActionsTrigger, d.minCapacity)
+	d.startIndex = seq
 	d.currentIndex = 0
+	d.buffered = 0
+	d.idle = 0
+	d.publish()
+	d.advanced.Broadcast()
+	if d.gapTimer != nil {
+		d.gapTimer.Stop()
+		d.gapTimer = nil
+	}
 }
 
-// NewDispatcher returns a new Dispatcher.
-func NewDispatcher(a Actions, startIndex int64, capacity int) *Dispatcher {
-	return &Dispatcher{
-		startIndex: startIndex,
-		actions:    a,
-		triggers:   make([]ActionsTrigger, capacity),
+// NewDispatcher returns a new Dispatcher that buffers up to capacity unordered events.
+func NewDispatcher(a Actions, startIndex int64, capacity int, opts ...DispatcherOption) *Dispatcher {
+	d := &Dispatcher{
+		initialIndex: startIndex,
+		startIndex:   startIndex,
+		actions:      a,
+		minCapacity:  DefaultInitialCapacity,
+		maxCapacity:  capacity,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.minCapacity > capacity {
+		d.minCapacity = capacity
+	}
+	if d.minCapacity < 1 {
+		d.minCapacity = 1
 	}
+	d.triggers = make([]ActionsTrigger, d.minCapacity)
+	d.advanced = sync.NewCond(&d.mu)
+	d.publish()
+	return d
 }
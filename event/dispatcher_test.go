@@ -0,0 +1,280 @@
+package event
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func seqEvent(seq int64) Event {
+	return Event{Seq: seq, ActionsTrigger: broadcastActionsTrigger{[]byte(fmt.Sprint(seq))}}
+}
+
+func seqCalls(seqs ...int64) []actionCall {
+	var calls []actionCall
+	for _, seq := range seqs {
+		calls = append(calls, broadcastCall([]byte(fmt.Sprint(seq))))
+	}
+	return calls
+}
+
+func TestDispatcherDispatch(t *testing.T) {
+	spy := &actionsCallSpy{}
+	d := NewDispatcher(spy, 1, 4)
+	for _, testCase := range []struct {
+		seq int64
+		err error
+	}{
+		{3, nil},
+		{2, nil},
+		{3, ErrSeqDuplicate},
+		{5, ErrSeqTooLarge},
+		{1, nil},
+		{1, ErrSeqTooSmall},
+		{5, nil},
+	} {
+		if err := d.Dispatch(seqEvent(testCase.seq)); err != testCase.err {
+			t.Errorf("Dispatch(%d) returned %v, want %v", testCase.seq, err, testCase.err)
+		}
+	}
+	if want := seqCalls(1, 2, 3); !reflect.DeepEqual(spy.callStack, want) {
+		t.Errorf("calls %s != %s", fmtCalls(spy.callStack), fmtCalls(want))
+	}
+	if seq, n := d.Seq(), d.Buffered(); seq != 4 || n != 1 {
+		t.Errorf("Seq() = %d, Buffered() = %d, want 4 and 1", seq, n)
+	}
+}
+
+type skippedRange struct {
+	from, to int64
+}
+
+func TestDispatcherGapMaxBuffered(t *testing.T) {
+	spy := &actionsCallSpy{}
+	var skipped []skippedRange
+	d := NewDispatcher(spy, 1, 10, WithGapPolicy(GapPolicy{
+		MaxBuffered: 2,
+		OnSkip: func(from, to int64) {
+			skipped = append(skipped, skippedRange{from, to})
+		},
+	}))
+	for _, seq := range []int64{3, 4, 6, 9, 10} {
+		d.Dispatch(seqEvent(seq))
+	}
+	if want := seqCalls(3, 4, 6); !reflect.DeepEqual(spy.callStack, want) {
+		t.Errorf("calls %s != %s", fmtCalls(spy.callStack), fmtCalls(want))
+	}
+	if want := []skippedRange{{1, 2}, {5, 5}}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("skipped %v, want %v", skipped, want)
+	}
+}
+
+func TestDispatcherGapTimeout(t *testing.T) {
+	spy := &actionsCallSpy{}
+	skipped := make(chan skippedRange, 1)
+	d := NewDispatcher(spy, 1, 10, WithGapPolicy(GapPolicy{
+		Timeout: 10 * time.Millisecond,
+		OnSkip: func(from, to int64) {
+			skipped <- skippedRange{from, to}
+		},
+	}))
+	d.Dispatch(seqEvent(2))
+	d.Dispatch(seqEvent(4))
+	for _, want := range []skippedRange{{1, 1}, {3, 3}} {
+		select {
+		case r := <-skipped:
+			if r != want {
+				t.Errorf("skipped %v, want %v", r, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("gap hasn't been skipped")
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if want := seqCalls(2, 4); !reflect.DeepEqual(spy.callStack, want) {
+		t.Errorf("calls %s != %s", fmtCalls(spy.callStack), fmtCalls(want))
+	}
+	if d.gapTimer != nil {
+		t.Error("gap timer should be stopped when there are no gaps")
+	}
+}
+
+func TestDispatcherGrowShrink(t *testing.T) {
+	spy := &actionsCallSpy{}
+	d := NewDispatcher(spy, 1, 10, WithInitialCapacity(2))
+	for _, testCase := range []struct {
+		seq  int64
+		err  error
+		size int
+	}{
+		{1, nil, 2},
+		{3, nil, 2},
+		{6, nil, 8}, // grows
+		{12, ErrSeqTooLarge, 8},
+		{11, nil, 10}, // grows up to capacity
+		{4, nil, 10},
+		{2, nil, 10},
+		{5, nil, 10},
+		{7, nil, 10},
+		{8, nil, 10},
+		{9, nil, 10},
+		{10, nil, 10}, // doesn't shrink right away
+	} {
+		if err := d.Dispatch(seqEvent(testCase.seq)); err != testCase.err {
+			t.Errorf("Dispatch(%d) returned %v, want %v", testCase.seq, err, testCase.err)
+		}
+		if len(d.triggers) != testCase.size {
+			t.Errorf("Dispatch(%d): store size %d, want %d", testCase.seq, len(d.triggers), testCase.size)
+		}
+	}
+	// halves once idle for as many events as its size
+	for seq := int64(12); seq <= 25; seq++ {
+		d.Dispatch(seqEvent(seq))
+		size := 10
+		switch {
+		case seq >= 25:
+			size = 2
+		case seq >= 20:
+			size = 5
+		}
+		if len(d.triggers) != size {
+			t.Errorf("Dispatch(%d): store size %d, want %d", seq, len(d.triggers), size)
+		}
+	}
+	if want := seqCalls(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20,
+		21, 22, 23, 24, 25); !reflect.DeepEqual(spy.callStack, want) {
+		t.Errorf("calls %s != %s", fmtCalls(spy.callStack), fmtCalls(want))
+	}
+}
+
+func TestDispatcherResetTo(t *testing.T) {
+	spy := &actionsCallSpy{}
+	d := NewDispatcher(spy, 1, 10)
+	d.Dispatch(seqEvent(1))
+	d.ResetTo(100)
+	if err := d.Dispatch(seqEvent(2)); err != ErrSeqTooSmall {
+		t.Errorf("Dispatch(2) after ResetTo(100) returned %v, want %v", err, ErrSeqTooSmall)
+	}
+	d.Dispatch(seqEvent(100))
+	d.Reset()
+	d.Dispatch(seqEvent(1))
+	if want := seqCalls(1, 100, 1); !reflect.DeepEqual(spy.callStack, want) {
+		t.Errorf("calls %s != %s", fmtCalls(spy.callStack), fmtCalls(want))
+	}
+	if seq := d.Seq(); seq != 2 {
+		t.Errorf("Seq() = %d, want 2", seq)
+	}
+}
+
+func TestDispatcherDo(t *testing.T) {
+	d := NewDispatcher(&actionsCallSpy{}, 1, 10)
+	d.Dispatch(seqEvent(1))
+	d.Dispatch(seqEvent(3))
+	var seq int64
+	d.Do(func(s int64) { seq = s })
+	if seq != 2 {
+		t.Errorf("Do called f with %d, want 2", seq)
+	}
+}
+
+func TestDispatcherDispatchWait(t *testing.T) {
+	spy := &actionsCallSpy{}
+	d := NewDispatcher(spy, 1, 2)
+	d.Dispatch(seqEvent(2))
+
+	errc := make(chan error)
+	go func() {
+		errc <- d.DispatchWait(nil, seqEvent(3))
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("DispatchWait returned %v before window moved", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	d.Dispatch(seqEvent(1))
+	if err := <-errc; err != nil {
+		t.Errorf("DispatchWait returned %v", err)
+	}
+	d.mu.Lock()
+	if want := seqCalls(1, 2, 3); !reflect.DeepEqual(spy.callStack, want) {
+		t.Errorf("calls %s != %s", fmtCalls(spy.callStack), fmtCalls(want))
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		errc <- d.DispatchWait(done, seqEvent(10))
+	}()
+	close(done)
+	if err := <-errc; err != ErrSeqTooLarge {
+		t.Errorf("DispatchWait returned %v, want %v", err, ErrSeqTooLarge)
+	}
+}
+
+func TestDispatcherDispatchWaitGap(t *testing.T) {
+	for _, testCase := range []struct {
+		name    string
+		policy  GapPolicy
+		seqs    []int64
+		calls   []actionCall
+		skipped []skippedRange
+	}{
+		{"timeout", GapPolicy{Timeout: 10 * time.Millisecond}, []int64{10}, seqCalls(10), []skippedRange{{1, 9}}},
+		{"max buffered", GapPolicy{MaxBuffered: 1}, []int64{10, 20}, seqCalls(10), []skippedRange{{1, 9}}},
+	} {
+		spy := &actionsCallSpy{}
+		skipped := make(chan skippedRange, 1)
+		testCase.policy.OnSkip = func(from, to int64) {
+			skipped <- skippedRange{from, to}
+		}
+		d := NewDispatcher(spy, 1, 2, WithGapPolicy(testCase.policy))
+		done := make(chan struct{})
+		errc := make(chan error, len(testCase.seqs))
+		for i, seq := range testCase.seqs {
+			go func(seq int64) {
+				errc <- d.DispatchWait(done, seqEvent(seq))
+			}(seq)
+			// make events wait in order
+			for deadline := time.Now().Add(time.Second); ; {
+				d.mu.Lock()
+				n := len(d.waiting)
+				d.mu.Unlock()
+				if n > i || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+		for _, want := range testCase.skipped {
+			select {
+			case r := <-skipped:
+				if r != want {
+					t.Errorf("%s: skipped %v, want %v", testCase.name, r, want)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s: gap hasn't been skipped", testCase.name)
+			}
+		}
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Errorf("%s: DispatchWait returned %v", testCase.name, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: DispatchWait hasn't returned", testCase.name)
+		}
+		close(done)
+		for range testCase.seqs[1:] {
+			if err := <-errc; err != ErrSeqTooLarge {
+				t.Errorf("%s: DispatchWait returned %v, want %v", testCase.name, err, ErrSeqTooLarge)
+			}
+		}
+		d.mu.Lock()
+		if !reflect.DeepEqual(spy.callStack, testCase.calls) {
+			t.Errorf("%s: calls %s != %s", testCase.name, fmtCalls(spy.callStack), fmtCalls(testCase.calls))
+		}
+		d.mu.Unlock()
+	}
+}
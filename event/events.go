@@ -5,23 +5,8 @@ import (
 	"fmt"
 )
 
-type event struct {
-	eType        byte
-	expectedArgs int
-}
-
-var (
-	follow       = event{'F', 2}
-	unfollow     = event{'U', 2}
-	broadcast    = event{'B', 0}
-	privateMsg   = event{'P', 2}
-	statusUpdate = event{'S', 1}
-
-	payloadFormat = "%d|%1s|%d|%d\n"
-)
-
 // ErrBadFormat is returned by Parse function when event's payload
-// does not conform the expected format (`Seq|Type[|Arg1[|Arg2]]\n`).
+// does not conform the expected format (`Seq|Type[|Arg1[|Arg2...]]\n`).
 var ErrBadFormat = errors.New("events: bad event payload format")
 
 // UnknownTypeError records unknown event type.
@@ -43,9 +28,10 @@ func (e *BadArgumentsNumberError) Error() string {
 	return fmt.Sprintf("events: expected %d arguments, got %d", e.Want, e.Got)
 }
 
-// Event implements ActionsTrigger and has a sequence number.
+// Event implements ActionsTrigger and has a sequence number and type.
 type Event struct {
-	Seq int64
+	Seq  int64
+	Type byte
 	ActionsTrigger
 }
 
@@ -56,7 +42,7 @@ type followActionsTrigger struct {
 
 func (f followActionsTrigger) Trigger(actions Actions) {
 	actions.Follow(f.followerID, f.followedID)
-	actions.SendMsg(f.followedID, f.msg)
+	actions.SendMsg(f.followerID, f.followedID, f.msg)
 }
 
 type unfollowActionsTrigger struct {
@@ -76,12 +62,22 @@ func (b broadcastActionsTrigger) Trigger(actions Actions) {
 }
 
 type privateMsgActionsTrigger struct {
-	userID int
-	msg    []byte
+	senderID, userID int
+	msg              []byte
 }
 
 func (p privateMsgActionsTrigger) Trigger(actions Actions) {
-	actions.SendMsg(p.userID, p.msg)
+	actions.SendMsg(p.senderID, p.userID, p.msg)
+}
+
+type mentionActionsTrigger struct {
+	senderID int
+	userIDs  []int
+	msg      []byte
+}
+
+func (m mentionActionsTrigger) Trigger(actions Actions) {
+	actions.SendMsgToUsers(m.senderID, m.userIDs, m.msg)
 }
 
 type statusUpdateActionsTrigger struct {
@@ -93,65 +89,245 @@ func (s statusUpdateActionsTrigger) Trigger(actions Actions) {
 	actions.SendMsgToFollowers(s.userID, s.msg)
 }
 
-// Parse parses event's payload
-func Parse(payload []byte) (Event, error) {
-	var (
-		e     Event
-		eType = []byte{0}
-		arg1  int
-		arg2  int
-	)
-	n, _ := fmt.Sscanf(string(payload), payloadFormat, &e.Seq, &eType, &arg1, &arg2)
-	if n < 2 {
-		return e, ErrBadFormat
-	}
-	t := eType[0]
-	nArgs := n - 2
-	var trig ActionsTrigger
-	switch t {
-	case follow.eType:
-		if nArgs != follow.expectedArgs {
-			return e, &BadArgumentsNumberError{Want: follow.expectedArgs, Got: nArgs}
-		}
-		trig = followActionsTrigger{
-			followerID: arg1,
-			followedID: arg2,
+type blockActionsTrigger struct {
+	blockerID, blockedID int
+}
+
+func (b blockActionsTrigger) Trigger(actions Actions) {
+	actions.Block(b.blockerID, b.blockedID)
+}
+
+type unblockActionsTrigger struct {
+	blockerID, blockedID int
+}
+
+func (u unblockActionsTrigger) Trigger(actions Actions) {
+	actions.Unblock(u.blockerID, u.blockedID)
+}
+
+type joinActionsTrigger struct {
+	userID, groupID int
+}
+
+func (j joinActionsTrigger) Trigger(actions Actions) {
+	actions.Join(j.userID, j.groupID)
+}
+
+type leaveActionsTrigger struct {
+	userID, groupID int
+}
+
+func (l leaveActionsTrigger) Trigger(actions Actions) {
+	actions.Leave(l.userID, l.groupID)
+}
+
+type groupMsgActionsTrigger struct {
+	senderID, groupID int
+	msg               []byte
+}
+
+func (g groupMsgActionsTrigger) Trigger(actions Actions) {
+	actions.SendMsgToGroup(g.senderID, g.groupID, g.msg)
+}
+
+func init() {
+	Register('F', 2, func(args Args, payload []byte) ActionsTrigger {
+		return followActionsTrigger{
+			followerID: args[0],
+			followedID: args[1],
 			msg:        payload,
 		}
-	case unfollow.eType:
-		if nArgs != unfollow.expectedArgs {
-			return e, &BadArgumentsNumberError{Want: unfollow.expectedArgs, Got: nArgs}
-		}
-		trig = unfollowActionsTrigger{
-			followerID: arg1,
-			followedID: arg2,
+	})
+	Register('U', 2, func(args Args, payload []byte) ActionsTrigger {
+		return unfollowActionsTrigger{
+			followerID: args[0],
+			followedID: args[1],
 		}
-	case broadcast.eType:
-		if nArgs != broadcast.expectedArgs {
-			return e, &BadArgumentsNumberError{Want: broadcast.expectedArgs, Got: nArgs}
-		}
-		trig = broadcastActionsTrigger{
+	})
+	Register('B', 0, func(args Args, payload []byte) ActionsTrigger {
+		return broadcastActionsTrigger{
 			msg: payload,
 		}
-	case privateMsg.eType:
-		if nArgs != privateMsg.expectedArgs {
-			return e, &BadArgumentsNumberError{Want: privateMsg.expectedArgs, Got: nArgs}
+	})
+	Register('P', 2, func(args Args, payload []byte) ActionsTrigger {
+		return privateMsgActionsTrigger{
+			senderID: args[0],
+			userID:   args[1],
+			msg:      payload,
 		}
-		trig = privateMsgActionsTrigger{
-			userID: arg2,
+	})
+	Register('S', 1, func(args Args, payload []byte) ActionsTrigger {
+		return statusUpdateActionsTrigger{
+			userID: args[0],
 			msg:    payload,
 		}
-	case statusUpdate.eType:
-		if nArgs != statusUpdate.expectedArgs {
-			return e, &BadArgumentsNumberError{Want: statusUpdate.expectedArgs, Got: nArgs}
+	})
+	RegisterVariadic('M', 1, func(args Args, list []int, payload []byte) ActionsTrigger {
+		return mentionActionsTrigger{
+			senderID: args[0],
+			userIDs:  list,
+			msg:      payload,
 		}
-		trig = statusUpdateActionsTrigger{
-			userID: arg1,
-			msg:    payload,
+	})
+	Register('K', 2, func(args Args, payload []byte) ActionsTrigger {
+		return blockActionsTrigger{
+			blockerID: args[0],
+			blockedID: args[1],
 		}
-	default:
-		return e, &UnknownTypeError{eType[0]}
+	})
+	Register('R', 2, func(args Args, payload []byte) ActionsTrigger {
+		return unblockActionsTrigger{
+			blockerID: args[0],
+			blockedID: args[1],
+		}
+	})
+	Register('J', 2, func(args Args, payload []byte) ActionsTrigger {
+		return joinActionsTrigger{
+			userID:  args[0],
+			groupID: args[1],
+		}
+	})
+	Register('L', 2, func(args Args, payload []byte) ActionsTrigger {
+		return leaveActionsTrigger{
+			userID:  args[0],
+			groupID: args[1],
+		}
+	})
+	Register('G', 2, func(args Args, payload []byte) ActionsTrigger {
+		return groupMsgActionsTrigger{
+			senderID: args[0],
+			groupID:  args[1],
+			msg:      payload,
+		}
+	})
+}
+
+// parseInt parses decimal integer (with optional sign) at the beginning of b.
+// It returns the number of bytes read, or 0 if there's no valid integer
+// (that fits in int64).
+func parseInt(b []byte) (v int64, n int) {
+	neg := false
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		neg = b[0] == '-'
+		n++
+	}
+	const cutoff = 1 << 63
+	var u uint64
+	start := n
+	for ; n < len(b) && '0' <= b[n] && b[n] <= '9'; n++ {
+		d := uint64(b[n] - '0')
+		if u > (cutoff-d)/10 {
+			return 0, 0 // overflow
+		}
+		u = u*10 + d
+	}
+	if n == start || (!neg && u >= cutoff) {
+		return 0, 0
+	}
+	if neg {
+		return -int64(u), n
+	}
+	return int64(u), n
+}
+
+// parseList parses non-empty, comma-separated list of integers at the
+// beginning of b, up to the first '|'. It returns the number of bytes read,
+// or 0 if there's no valid list.
+func parseList(b []byte) (list []int, n int) {
+	l := 1
+	for _, c := range b {
+		if c == '|' {
+			break
+		}
+		if c == ',' {
+			l++
+		}
+	}
+	list = make([]int, l)
+	for i := range list {
+		if i > 0 {
+			if n >= len(b) || b[n] != ',' {
+				return nil, 0
+			}
+			n++
+		}
+		v, m := parseInt(b[n:])
+		if m == 0 || int64(int(v)) != v {
+			return nil, 0
+		}
+		list[i] = int(v)
+		n += m
+	}
+	return list, n
+}
+
+// Parse parses event's payload (`Seq|Type[|Arg1[|Arg2...]]\n`)
+// of one of the registered event types. Like the former fmt.Sscanf based
+// parser, it returns BadArgumentsNumberError with the number of arguments
+// preceding the first one that isn't valid, but it rejects trailing garbage.
+// Payload is retained by returned Event. The only allocations made are
+// the event's ActionsTrigger and the list of integers of variadic types.
+func Parse(payload []byte) (Event, error) {
+	var e Event
+	p := payload
+	if l := len(p); l > 0 && p[l-1] == '\n' {
+		p = p[:l-1]
+	}
+	seq, n := parseInt(p)
+	if n == 0 || n+1 >= len(p) || p[n] != '|' {
+		return e, ErrBadFormat
+	}
+	e.Seq = seq
+	e.Type = p[n+1]
+	p = p[n+2:]
+
+	et := lookupType(e.Type)
+	if et == nil {
+		return e, &UnknownTypeError{e.Type}
+	}
+	if len(p) > 0 && p[0] != '|' {
+		return e, ErrBadFormat
+	}
+	want := et.arity
+	if et.variadic() {
+		want++
+	}
+	got := 0
+	for _, c := range p {
+		if c == '|' {
+			got++
+		}
+	}
+	if got != want {
+		return e, &BadArgumentsNumberError{Want: want, Got: got}
+	}
+
+	var (
+		args Args
+		list []int
+	)
+	for i := 0; i < want; i++ {
+		p = p[1:]
+		var n int
+		if i == et.arity {
+			list, n = parseList(p)
+		} else {
+			var v int64
+			v, n = parseInt(p)
+			if int64(int(v)) != v {
+				n = 0
+			}
+			args[i] = int(v)
+		}
+		if n == 0 || (n < len(p) && p[n] != '|') {
+			return e, &BadArgumentsNumberError{Want: want, Got: i}
+		}
+		p = p[n:]
+	}
+	if et.variadic() {
+		e.ActionsTrigger = et.newVariadicTrigger(args, list, payload)
+	} else {
+		e.ActionsTrigger = et.newTrigger(args, payload)
 	}
-	e.ActionsTrigger = trig
 	return e, nil
 }
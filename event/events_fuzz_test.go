@@ -0,0 +1,35 @@
+//go:build go1.18
+// +build go1.18
+
+package event
+
+import (
+	"reflect"
+	"testing"
+)
+
+// FuzzParse checks that events of built-in types accepted by Parse
+// are equal to the ones returned by the former fmt.Sscanf based parser.
+func FuzzParse(f *testing.F) {
+	for _, p := range benchPayloads {
+		f.Add(p)
+	}
+	f.Add([]byte("-1|F|+2|-3"))
+	f.Add([]byte("1|B|x\n"))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		e, err := Parse(payload)
+		if err != nil {
+			return
+		}
+		want, werr := sscanfParse(payload)
+		if _, ok := werr.(*UnknownTypeError); ok {
+			return // registered by other tests
+		}
+		if werr != nil {
+			t.Fatalf("%q: accepted, but reference parser returned error %v", payload, werr)
+		}
+		if !reflect.DeepEqual(e, want) {
+			t.Fatalf("%q: parsed %#v, reference parser returned %#v", payload, e, want)
+		}
+	})
+}
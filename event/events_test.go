@@ -17,14 +17,38 @@ func unfollowCall(a1, a2 int) actionCall {
 	return actionCall(fmt.Sprintf("Unfollow(%#v, %#v)", a1, a2))
 }
 
-func sendMsgCall(a1 int, a2 []byte) actionCall {
-	return actionCall(fmt.Sprintf("SendMsg(%#v, %#v)", a1, a2))
+func blockCall(a1, a2 int) actionCall {
+	return actionCall(fmt.Sprintf("Block(%#v, %#v)", a1, a2))
+}
+
+func unblockCall(a1, a2 int) actionCall {
+	return actionCall(fmt.Sprintf("Unblock(%#v, %#v)", a1, a2))
+}
+
+func joinCall(a1, a2 int) actionCall {
+	return actionCall(fmt.Sprintf("Join(%#v, %#v)", a1, a2))
+}
+
+func leaveCall(a1, a2 int) actionCall {
+	return actionCall(fmt.Sprintf("Leave(%#v, %#v)", a1, a2))
+}
+
+func sendMsgCall(a1, a2 int, a3 []byte) actionCall {
+	return actionCall(fmt.Sprintf("SendMsg(%#v, %#v, %#v)", a1, a2, a3))
 }
 
 func sendMsgToFollowersCall(a1 int, a2 []byte) actionCall {
 	return actionCall(fmt.Sprintf("SendMsgToFollowers(%#v, %#v)", a1, a2))
 }
 
+func sendMsgToUsersCall(a1 int, a2 []int, a3 []byte) actionCall {
+	return actionCall(fmt.Sprintf("SendMsgToUsers(%#v, %#v, %#v)", a1, a2, a3))
+}
+
+func sendMsgToGroupCall(a1, a2 int, a3 []byte) actionCall {
+	return actionCall(fmt.Sprintf("SendMsgToGroup(%#v, %#v, %#v)", a1, a2, a3))
+}
+
 func broadcastCall(a1 []byte) actionCall {
 	return actionCall(fmt.Sprintf("Broadcast(%#v)", a1))
 }
@@ -41,14 +65,38 @@ func (a *actionsCallSpy) Unfollow(a1, a2 int) {
 	a.callStack = append(a.callStack, unfollowCall(a1, a2))
 }
 
-func (a *actionsCallSpy) SendMsg(a1 int, a2 []byte) {
-	a.callStack = append(a.callStack, sendMsgCall(a1, a2))
+func (a *actionsCallSpy) Block(a1, a2 int) {
+	a.callStack = append(a.callStack, blockCall(a1, a2))
+}
+
+func (a *actionsCallSpy) Unblock(a1, a2 int) {
+	a.callStack = append(a.callStack, unblockCall(a1, a2))
+}
+
+func (a *actionsCallSpy) Join(a1, a2 int) {
+	a.callStack = append(a.callStack, joinCall(a1, a2))
+}
+
+func (a *actionsCallSpy) Leave(a1, a2 int) {
+	a.callStack = append(a.callStack, leaveCall(a1, a2))
+}
+
+func (a *actionsCallSpy) SendMsg(a1, a2 int, a3 []byte) {
+	a.callStack = append(a.callStack, sendMsgCall(a1, a2, a3))
 }
 
 func (a *actionsCallSpy) SendMsgToFollowers(a1 int, a2 []byte) {
 	a.callStack = append(a.callStack, sendMsgToFollowersCall(a1, a2))
 }
 
+func (a *actionsCallSpy) SendMsgToUsers(a1 int, a2 []int, a3 []byte) {
+	a.callStack = append(a.callStack, sendMsgToUsersCall(a1, a2, a3))
+}
+
+func (a *actionsCallSpy) SendMsgToGroup(a1, a2 int, a3 []byte) {
+	a.callStack = append(a.callStack, sendMsgToGroupCall(a1, a2, a3))
+}
+
 func (a *actionsCallSpy) Broadcast(a1 []byte) {
 	a.callStack = append(a.callStack, broadcastCall(a1))
 }
@@ -69,7 +117,7 @@ func TestParseEventsSuccess(t *testing.T) {
 	}{
 		{"666|F|60|50\n", 666, []actionCall{
 			followCall(60, 50),
-			sendMsgCall(50, []byte("666|F|60|50\n")),
+			sendMsgCall(60, 50, []byte("666|F|60|50\n")),
 		}},
 		{"1|U|12|9\n", 1, []actionCall{
 			unfollowCall(12, 9),
@@ -78,11 +126,32 @@ func TestParseEventsSuccess(t *testing.T) {
 			broadcastCall([]byte("542532|B\n")),
 		}},
 		{"43|P|32|56\n", 43, []actionCall{
-			sendMsgCall(56, []byte("43|P|32|56\n")),
+			sendMsgCall(32, 56, []byte("43|P|32|56\n")),
 		}},
 		{"634|S|32\n", 634, []actionCall{
 			sendMsgToFollowersCall(32, []byte("634|S|32\n")),
 		}},
+		{"7|K|1|2\n", 7, []actionCall{
+			blockCall(1, 2),
+		}},
+		{"8|R|1|2\n", 8, []actionCall{
+			unblockCall(1, 2),
+		}},
+		{"12|M|1|2,-3,2\n", 12, []actionCall{
+			sendMsgToUsersCall(1, []int{2, -3, 2}, []byte("12|M|1|2,-3,2\n")),
+		}},
+		{"13|M|1|2\n", 13, []actionCall{
+			sendMsgToUsersCall(1, []int{2}, []byte("13|M|1|2\n")),
+		}},
+		{"9|J|1|100\n", 9, []actionCall{
+			joinCall(1, 100),
+		}},
+		{"10|L|1|100\n", 10, []actionCall{
+			leaveCall(1, 100),
+		}},
+		{"11|G|2|100\n", 11, []actionCall{
+			sendMsgToGroupCall(2, 100, []byte("11|G|2|100\n")),
+		}},
 	} {
 		event, err := Parse([]byte(testCase.payloadStr))
 		if err != nil {
@@ -93,6 +162,9 @@ func TestParseEventsSuccess(t *testing.T) {
 			t.Errorf("%s: want sequence: %d, have: %d", testCase.payloadStr, testCase.seq, event.Seq)
 			continue
 		}
+		if want := testCase.payloadStr[strings.IndexByte(testCase.payloadStr, '|')+1]; event.Type != want {
+			t.Errorf("%s: want type: %q, have: %q", testCase.payloadStr, want, event.Type)
+		}
 		spy := &actionsCallSpy{}
 		event.Trigger(spy)
 		if !reflect.DeepEqual(spy.callStack, testCase.calls) {
@@ -100,3 +172,186 @@ func TestParseEventsSuccess(t *testing.T) {
 		}
 	}
 }
+
+func TestParseEventsFailure(t *testing.T) {
+	for _, testCase := range []struct {
+		payloadStr string
+		err        error
+	}{
+		{"", ErrBadFormat},
+		{"\n", ErrBadFormat},
+		{"x|B\n", ErrBadFormat},
+		{"1\n", ErrBadFormat},
+		{"1|\n", ErrBadFormat},
+		{" 1|B\n", ErrBadFormat},
+		{"1|BB\n", ErrBadFormat},
+		{"1|B|x\n", &BadArgumentsNumberError{Want: 0, Got: 1}},    // trailing garbage
+		{"1|P|1|2 \n", &BadArgumentsNumberError{Want: 2, Got: 1}}, // trailing garbage
+		{"1|B\n\n", ErrBadFormat},
+		{"1|F|1|\n", &BadArgumentsNumberError{Want: 2, Got: 1}},
+		{"1|F|a|b\n", &BadArgumentsNumberError{Want: 2, Got: 0}},
+		{"1|F|1a|2\n", &BadArgumentsNumberError{Want: 2, Got: 0}},
+		{"9223372036854775808|B\n", ErrBadFormat}, // overflow
+		{"1|X\n", &UnknownTypeError{'X'}},
+		{"1|X|1,2\n", &UnknownTypeError{'X'}},
+		{"1|XY|1\n", &UnknownTypeError{'X'}},
+		{"1|F|1\n", &BadArgumentsNumberError{Want: 2, Got: 1}},
+		{"1|F|1|2|3\n", &BadArgumentsNumberError{Want: 2, Got: 3}},
+		{"1|B|1\n", &BadArgumentsNumberError{Want: 0, Got: 1}},
+		{"1|S\n", &BadArgumentsNumberError{Want: 1, Got: 0}},
+		{"1|M|1|\n", &BadArgumentsNumberError{Want: 2, Got: 1}},
+		{"1|M|1|2,\n", &BadArgumentsNumberError{Want: 2, Got: 1}},
+		{"1|M|1|,2\n", &BadArgumentsNumberError{Want: 2, Got: 1}},
+		{"1|M|1|2,,3\n", &BadArgumentsNumberError{Want: 2, Got: 1}},
+		{"1|M|1|2,3x\n", &BadArgumentsNumberError{Want: 2, Got: 1}},
+		{"1|M|1,2|3\n", &BadArgumentsNumberError{Want: 2, Got: 0}},
+		{"1|F|1|2,3\n", &BadArgumentsNumberError{Want: 2, Got: 1}},
+		{"1|M|1\n", &BadArgumentsNumberError{Want: 2, Got: 1}},
+		{"1|M|1|2|3\n", &BadArgumentsNumberError{Want: 2, Got: 3}},
+	} {
+		if _, err := Parse([]byte(testCase.payloadStr)); !reflect.DeepEqual(err, testCase.err) {
+			t.Errorf("%q: error %v, want %v", testCase.payloadStr, err, testCase.err)
+		}
+	}
+}
+
+func TestParseInt(t *testing.T) {
+	for _, testCase := range []struct {
+		s string
+		v int64
+		n int
+	}{
+		{"0", 0, 1},
+		{"123|", 123, 3},
+		{"+7", 7, 2},
+		{"-9223372036854775808", -9223372036854775808, 20},
+		{"9223372036854775807", 9223372036854775807, 19},
+		{"9223372036854775808", 0, 0},
+		{"-9223372036854775809", 0, 0},
+		{"-", 0, 0},
+		{"|1", 0, 0},
+	} {
+		if v, n := parseInt([]byte(testCase.s)); v != testCase.v || n != testCase.n {
+			t.Errorf("parseInt(%q) = %d, %d, want %d, %d", testCase.s, v, n, testCase.v, testCase.n)
+		}
+	}
+}
+
+type reactionActionsTrigger struct {
+	userID, reactionID int
+	msg                []byte
+}
+
+func (r reactionActionsTrigger) Trigger(actions Actions) {
+	actions.SendMsg(0, r.userID, r.msg)
+}
+
+func TestRegister(t *testing.T) {
+	if lookupType('Z') == nil { // not registered by previous run
+		Register('Z', 3, func(args Args, payload []byte) ActionsTrigger {
+			return reactionActionsTrigger{userID: args[1], reactionID: args[2], msg: payload}
+		})
+	}
+
+	payload := []byte("7|Z|1|2|3\n")
+	e, err := Parse(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Event{7, 'Z', reactionActionsTrigger{userID: 2, reactionID: 3, msg: payload}}
+	if !reflect.DeepEqual(e, want) {
+		t.Errorf("parsed %#v, want %#v", e, want)
+	}
+	if _, err := Parse([]byte("7|Z|1|2\n")); !reflect.DeepEqual(err, &BadArgumentsNumberError{Want: 3, Got: 2}) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	for _, testCase := range []struct {
+		name       string
+		t          byte
+		arity      int
+		newTrigger NewTriggerFunc
+	}{
+		{"registered twice", 'F', 2, func(Args, []byte) ActionsTrigger { return nil }},
+		{"negative arity", 'Y', -1, func(Args, []byte) ActionsTrigger { return nil }},
+		{"too many arguments", 'Y', MaxArgs + 1, func(Args, []byte) ActionsTrigger { return nil }},
+		{"nil constructor", 'Y', 0, nil},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: Register didn't panic", testCase.name)
+				}
+			}()
+			Register(testCase.t, testCase.arity, testCase.newTrigger)
+		}()
+	}
+	if _, err := Parse([]byte("1|Y\n")); !reflect.DeepEqual(err, &UnknownTypeError{'Y'}) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// sscanfParse is the former, fmt.Sscanf based implementation of Parse,
+// kept as a reference (it accepts trailing garbage).
+func sscanfParse(payload []byte) (Event, error) {
+	var (
+		e     Event
+		eType = []byte{0}
+		arg1  int
+		arg2  int
+	)
+	n, _ := fmt.Sscanf(string(payload), "%d|%1s|%d|%d\n", &e.Seq, &eType, &arg1, &arg2)
+	if n < 2 {
+		return e, ErrBadFormat
+	}
+	e.Type = eType[0]
+	nArgs := n - 2
+	want := map[byte]int{'F': 2, 'U': 2, 'B': 0, 'P': 2, 'S': 1}
+	expectedArgs, ok := want[e.Type]
+	if !ok {
+		return e, &UnknownTypeError{e.Type}
+	}
+	if nArgs != expectedArgs {
+		return e, &BadArgumentsNumberError{Want: expectedArgs, Got: nArgs}
+	}
+	switch e.Type {
+	case 'F':
+		e.ActionsTrigger = followActionsTrigger{followerID: arg1, followedID: arg2, msg: payload}
+	case 'U':
+		e.ActionsTrigger = unfollowActionsTrigger{followerID: arg1, followedID: arg2}
+	case 'B':
+		e.ActionsTrigger = broadcastActionsTrigger{msg: payload}
+	case 'P':
+		e.ActionsTrigger = privateMsgActionsTrigger{senderID: arg1, userID: arg2, msg: payload}
+	case 'S':
+		e.ActionsTrigger = statusUpdateActionsTrigger{userID: arg1, msg: payload}
+	}
+	return e, nil
+}
+
+var benchPayloads = [][]byte{
+	[]byte("666|F|60|50\n"),
+	[]byte("1|U|12|9\n"),
+	[]byte("542532|B\n"),
+	[]byte("43|P|32|56\n"),
+	[]byte("634|S|32\n"),
+}
+
+func BenchmarkParse(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		parse func([]byte) (Event, error)
+	}{
+		{"bytes", Parse},
+		{"sscanf", sscanfParse},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := bench.parse(benchPayloads[i%len(benchPayloads)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -6,9 +6,19 @@ type Actions interface {
 	Follow(followerID, followedID int)
 	Unfollow(followerID, followedID int)
 
+	// block relation mutating actions
+	Block(blockerID, blockedID int)
+	Unblock(blockerID, blockedID int)
+
+	// group membership mutating actions
+	Join(userID, groupID int)
+	Leave(userID, groupID int)
+
 	// notify actions
-	SendMsg(userID int, msg []byte)
+	SendMsg(senderID, userID int, msg []byte)
+	SendMsgToUsers(senderID int, userIDs []int, msg []byte)
 	SendMsgToFollowers(userID int, msg []byte)
+	SendMsgToGroup(senderID, groupID int, msg []byte)
 	Broadcast(msg []byte)
 }
 
@@ -16,3 +26,11 @@ type Actions interface {
 type ActionsTrigger interface {
 	Trigger(Actions)
 }
+
+// Sequencer is the interface implemented by Actions that need to know
+// sequence number of the event, whose actions are being triggered.
+//
+// Dispatcher calls SetSeq before triggering actions of each event.
+type Sequencer interface {
+	SetSeq(seq int64)
+}
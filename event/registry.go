@@ -0,0 +1,97 @@
+package event
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// MaxArgs is the maximum number of integer arguments of an event type.
+const MaxArgs = 4
+
+// Args holds integer arguments of parsed event. Only the first arity
+// arguments of event's type are set.
+type Args [MaxArgs]int
+
+// NewTriggerFunc returns ActionsTrigger of parsed event with given
+// arguments. Payload (including the trailing new line) may be retained.
+type NewTriggerFunc func(args Args, payload []byte) ActionsTrigger
+
+// NewVariadicTriggerFunc returns ActionsTrigger of parsed event with given
+// arguments followed by a list of integers. Payload (including the trailing
+// new line) and list may be retained.
+type NewVariadicTriggerFunc func(args Args, list []int, payload []byte) ActionsTrigger
+
+// eventType describes registered event type.
+type eventType struct {
+	arity              int
+	newTrigger         NewTriggerFunc
+	newVariadicTrigger NewVariadicTriggerFunc
+}
+
+// types is a table of registered event types indexed by type code.
+// It's replaced (never modified) by Register so that Parse can read it
+// without locking.
+type types [256]*eventType
+
+var (
+	typesMu    sync.Mutex
+	typesTable atomic.Value // *types
+)
+
+// loadTypes returns current table of registered event types.
+func loadTypes() *types {
+	if tt, ok := typesTable.Load().(*types); ok {
+		return tt
+	}
+	return &types{}
+}
+
+// Register makes event type with code t, taking arity integer arguments,
+// available to Parse. Parsed events of that type trigger actions
+// of ActionsTrigger returned by newTrigger.
+//
+// Register panics if type t is already registered, arity is out of
+// [0, MaxArgs] range or newTrigger is nil. It's meant to be called
+// from init functions.
+func Register(t byte, arity int, newTrigger NewTriggerFunc) {
+	if newTrigger == nil {
+		panic(fmt.Sprintf("events: nil trigger constructor of type %q", t))
+	}
+	register(t, &eventType{arity: arity, newTrigger: newTrigger})
+}
+
+// RegisterVariadic works like Register, but events of type t take one more
+// argument after arity integer arguments: a non-empty, comma-separated list
+// of integers (`Seq|Type|Arg1|...|ArgN|Int1,Int2,...\n`).
+func RegisterVariadic(t byte, arity int, newTrigger NewVariadicTriggerFunc) {
+	if newTrigger == nil {
+		panic(fmt.Sprintf("events: nil trigger constructor of type %q", t))
+	}
+	register(t, &eventType{arity: arity, newVariadicTrigger: newTrigger})
+}
+
+func register(t byte, et *eventType) {
+	if et.arity < 0 || et.arity > MaxArgs {
+		panic(fmt.Sprintf("events: arity %d of type %q out of range", et.arity, t))
+	}
+	typesMu.Lock()
+	defer typesMu.Unlock()
+	old := loadTypes()
+	if old[t] != nil {
+		panic(fmt.Sprintf("events: type %q registered twice", t))
+	}
+	tt := *old
+	tt[t] = et
+	typesTable.Store(&tt)
+}
+
+// variadic reports whether event type takes a list of integers.
+func (et *eventType) variadic() bool {
+	return et.newVariadicTrigger != nil
+}
+
+// lookupType returns registered event type with code t, or nil.
+func lookupType(t byte) *eventType {
+	return loadTypes()[t]
+}
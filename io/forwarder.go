@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -43,17 +44,55 @@ func (v *vecWriter) Flush() error {
 	return err
 }
 
+// ForwardStats records number of messages handled by a single Forward call.
+type ForwardStats struct {
+	// Written is the number of messages successfully written (and flushed) to the writer.
+	Written int
+	// Dropped is the number of messages taken from the channel that couldn't be written.
+	Dropped int
+}
+
+// Counters holds totals of all Forward calls of MaxLatencyForwarder.
+type Counters struct {
+	// Flushes is the number of writer flushes.
+	Flushes int64
+	// Bytes is the number of bytes written.
+	Bytes int64
+}
+
 // MaxLatencyForwarder takes messages from given channel and forwards them
 // back to a given writer.
 type MaxLatencyForwarder struct {
 	flushWriterFactory func(io.Writer) flushWriter
 	latency            time.Duration
+	counters           *Counters
+}
+
+// Counters returns totals of all Forward calls.
+func (m MaxLatencyForwarder) Counters() Counters {
+	return Counters{
+		Flushes: atomic.LoadInt64(&m.counters.Flushes),
+		Bytes:   atomic.LoadInt64(&m.counters.Bytes),
+	}
 }
 
 // Forward forwards messages from src channel into a dst writer.
 // It stops forwarding on src or done channel close and on any write error.
-func (m MaxLatencyForwarder) Forward(done <-chan struct{}, dst io.Writer, src <-chan []byte) {
+// On src channel close all the messages from it are written before it returns,
+// on done channel close only the ones already queued in src.
+func (m MaxLatencyForwarder) Forward(done <-chan struct{}, dst io.Writer, src <-chan []byte) (stats ForwardStats) {
 	fw := m.flushWriterFactory(dst)
+	// messages written since last flush
+	pending := 0
+	flush := func() {
+		atomic.AddInt64(&m.counters.Flushes, 1)
+		if err := fw.Flush(); err != nil {
+			stats.Dropped += pending
+		} else {
+			stats.Written += pending
+		}
+		pending = 0
+	}
 	var flushC <-chan time.Time
 	if m.latency > 0 {
 		t := time.NewTicker(m.latency)
@@ -62,21 +101,43 @@ func (m MaxLatencyForwarder) Forward(done <-chan struct{}, dst io.Writer, src <-
 	} else {
 		flushC = make(chan time.Time)
 	}
+	write := func(msg []byte) bool {
+		pending++
+		n, err := fw.Write(msg)
+		atomic.AddInt64(&m.counters.Bytes, int64(n))
+		if err != nil {
+			stats.Dropped += pending
+			return false
+		}
+		return true
+	}
 	for {
 		select {
 		case msg, more := <-src:
 			if !more {
-				fw.Flush()
+				flush()
 				return
 			}
-			if _, err := fw.Write(msg); err != nil {
+			if !write(msg) {
 				return
 			}
 		case <-flushC:
-			fw.Flush()
+			flush()
 		case <-done:
-			fw.Flush()
-			return
+			for {
+				select {
+				case msg, more := <-src:
+					if more && write(msg) {
+						continue
+					}
+					if !more {
+						flush()
+					}
+				default:
+					flush()
+				}
+				return
+			}
 		}
 	}
 }
@@ -102,5 +163,5 @@ func NewMaxLatencyForwarder(bufSize int, latency time.Duration, useWritev bool)
 			return directWriter{w}
 		}
 	}
-	return MaxLatencyForwarder{f, latency}
+	return MaxLatencyForwarder{f, latency, &Counters{}}
 }
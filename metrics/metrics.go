@@ -0,0 +1,197 @@
+// Package metrics implements a minimal registry of metrics
+// exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Type is a metric type.
+type Type string
+
+// Metric types.
+const (
+	CounterType   Type = "counter"
+	GaugeType     Type = "gauge"
+	HistogramType Type = "histogram"
+)
+
+// Label is a metric label.
+type Label struct {
+	Name, Value string
+}
+
+// Sample is a single metric value.
+type Sample struct {
+	// Suffix is appended to the metric name (eg. "_bucket" for histograms).
+	Suffix string
+	Labels []Label
+	Value  float64
+}
+
+type family struct {
+	name, help string
+	typ        Type
+	collect    func() []Sample
+}
+
+// Registry holds metrics families and writes them in the Prometheus
+// text format. It implements http.Handler interface.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+// Register registers metrics family of given name and type,
+// whose samples are returned by collect function.
+func (r *Registry) Register(name, help string, typ Type, collect func() []Sample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, family{name, help, typ, collect})
+}
+
+// RegisterFunc registers single value metric returned by f.
+func (r *Registry) RegisterFunc(name, help string, typ Type, f func() float64) {
+	r.Register(name, help, typ, func() []Sample {
+		return []Sample{{Value: f()}}
+	})
+}
+
+// RegisterHistogram registers histogram h.
+func (r *Registry) RegisterHistogram(name, help string, h *Histogram) {
+	r.Register(name, help, HistogramType, h.samples)
+}
+
+// WriteTo writes all the registered metrics to w.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := r.families
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.collect() {
+			bw.WriteString(f.name)
+			bw.WriteString(s.Suffix)
+			if len(s.Labels) > 0 {
+				bw.WriteByte('{')
+				for i, l := range s.Labels {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					fmt.Fprintf(bw, "%s=\"%s\"", l.Name, escapeLabelValue(l.Value))
+				}
+				bw.WriteByte('}')
+			}
+			bw.WriteByte(' ')
+			bw.WriteString(formatValue(s.Value))
+			bw.WriteByte('\n')
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Histogram counts observations in buckets. It's safe for concurrent use.
+type Histogram struct {
+	bounds  []float64
+	counts  []int64 // accessed atomically, last one is +Inf bucket
+	sumBits uint64  // accessed atomically
+}
+
+// NewHistogram returns histogram with buckets of given (sorted) upper bounds.
+func NewHistogram(bounds ...float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe adds observation v.
+func (h *Histogram) Observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) samples() []Sample {
+	samples := make([]Sample, 0, len(h.counts)+2)
+	var count int64
+	for i := range h.counts {
+		count += atomic.LoadInt64(&h.counts[i])
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = formatValue(h.bounds[i])
+		}
+		samples = append(samples, Sample{
+			Suffix: "_bucket",
+			Labels: []Label{{"le", le}},
+			Value:  float64(count),
+		})
+	}
+	sum := math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+	return append(samples,
+		Sample{Suffix: "_sum", Value: sum},
+		Sample{Suffix: "_count", Value: float64(count)})
+}
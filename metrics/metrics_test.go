@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := &Registry{}
+	r.RegisterFunc("requests_total", "Number of requests.", CounterType, func() float64 { return 42 })
+	r.Register("temperature", "Temperature \\ in\ncelsius.", GaugeType, func() []Sample {
+		return []Sample{
+			{Labels: []Label{{"room", `a"b`}, {"floor", "1"}}, Value: 21.5},
+			{Labels: []Label{{"room", "c"}, {"floor", "2"}}, Value: math.Inf(-1)},
+		}
+	})
+	h := NewHistogram(1, 10)
+	for _, v := range []float64{0, 1, 5, 100} {
+		h.Observe(v)
+	}
+	r.RegisterHistogram("size", "Size.", h)
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total 42
+# HELP temperature Temperature \\ in\ncelsius.
+# TYPE temperature gauge
+temperature{room="a\"b",floor="1"} 21.5
+temperature{room="c",floor="2"} -Inf
+# HELP size Size.
+# TYPE size histogram
+size_bucket{le="1"} 2
+size_bucket{le="10"} 3
+size_bucket{le="+Inf"} 4
+size_sum 106
+size_count 4
+`
+	if have := buf.String(); have != want {
+		t.Errorf("Registry wrote:\n%s\nwant:\n%s", have, want)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, want %d", n, buf.Len())
+	}
+}
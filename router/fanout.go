@@ -0,0 +1,119 @@
+package router
+
+import "sync"
+
+// fanoutJob is a message to be sent to channels of fanout worker,
+// or a barrier (with msg and conns unset) to be closed by it.
+type fanoutJob struct {
+	msg     []byte
+	conns   cSet
+	barrier chan struct{}
+}
+
+// fanout sends messages to channels in worker goroutines, each one owning
+// a bounded queue and channels of users whose identifiers map to it,
+// so that messages are delivered to every user in the order they were queued.
+type fanout struct {
+	// held for reading while queueing, so that queues aren't closed meanwhile
+	mu      sync.RWMutex
+	closed  bool
+	queues  []chan fanoutJob
+	workers sync.WaitGroup
+
+	sendNow func([]byte, cSet)
+}
+
+func newFanout(workers, queueSize int, send func([]byte, cSet)) *fanout {
+	f := &fanout{
+		queues:  make([]chan fanoutJob, workers),
+		sendNow: send,
+	}
+	f.workers.Add(workers)
+	for i := range f.queues {
+		q := make(chan fanoutJob, queueSize)
+		f.queues[i] = q
+		go func() {
+			defer f.workers.Done()
+			for job := range q {
+				if job.barrier != nil {
+					close(job.barrier)
+					continue
+				}
+				send(job.msg, job.conns)
+			}
+		}()
+	}
+	return f
+}
+
+func (f *fanout) worker(userID int) int {
+	return int(uint(userID) % uint(len(f.queues)))
+}
+
+// send queues msg to be sent to channels of s, it blocks while
+// queue of any worker owning these channels is full.
+// Once f is closed, it sends msg itself.
+func (f *fanout) send(msg []byte, s cSet) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		f.sendNow(msg, s)
+		return
+	}
+	if len(f.queues) == 1 {
+		if len(s) > 0 {
+			conns := make(cSet, len(s))
+			conns.extend(s)
+			f.queues[0] <- fanoutJob{msg: msg, conns: conns}
+		}
+		return
+	}
+	byWorker := make(map[int]cSet)
+	for c, cn := range s {
+		w := f.worker(cn.userID)
+		conns, ok := byWorker[w]
+		if !ok {
+			conns = make(cSet)
+			byWorker[w] = conns
+		}
+		conns.add(c, cn)
+	}
+	for w, conns := range byWorker {
+		f.queues[w] <- fanoutJob{msg: msg, conns: conns}
+	}
+}
+
+// wait waits until worker owning channels of userID
+// sends all the messages queued so far.
+func (f *fanout) wait(userID int) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return // nothing is queued anymore
+	}
+	barrier := make(chan struct{})
+	f.queues[f.worker(userID)] <- fanoutJob{barrier: barrier}
+	<-barrier
+}
+
+// close closes queues and waits until workers send messages queued so far.
+func (f *fanout) close() {
+	f.mu.Lock()
+	if !f.closed {
+		f.closed = true
+		for _, q := range f.queues {
+			close(q)
+		}
+	}
+	f.mu.Unlock()
+	f.workers.Wait()
+}
+
+// queued returns the number of queued messages (per worker).
+func (f *fanout) queued() int {
+	n := 0
+	for _, q := range f.queues {
+		n += len(q)
+	}
+	return n
+}
@@ -1,11 +1,5 @@
 package router
 
-var closed = make(chan int)
-
-func init() {
-	close(closed)
-}
-
 // Graph represents a directed graph
 type Graph interface {
 	// Connect creates directed edge between vertices head and tail.
@@ -14,13 +8,33 @@ type Graph interface {
 	// Disconnect removes directed edge between vertices head and tail.
 	Disconnect(head, tail int)
 
-	// Neighbors returns channel of all direct predecessors of vertex head.
-	Neighbors(head int) <-chan int
+	// Neighbors calls f for each direct successor of vertex head
+	// until f returns false. Graph must not be modified by f.
+	Neighbors(head int, f func(tail int) bool)
+
+	// Degree returns number of direct successors of vertex head.
+	Degree(head int) int
+
+	// Edges calls f for each edge of the graph until f returns false.
+	// Graph must not be modified by f.
+	Edges(f func(head, tail int) bool)
+}
+
+// Graphs maps graph backend names to Graph constructors.
+var Graphs = map[string]func() Graph{
+	"sparse": NewSparseGraph,
+	"dense":  NewDenseGraph,
 }
 
 // "adjacency list" with O(1) amortized connect/disconnect time
 type sparseGraph map[int]map[int]struct{}
 
+// NewSparseGraph returns Graph backed by adjacency lists.
+// It's suited for sparse graphs and arbitrary vertex identifiers.
+func NewSparseGraph() Graph {
+	return make(sparseGraph)
+}
+
 func (g sparseGraph) Connect(head, tail int) {
 	vertices, ok := g[head]
 	if !ok {
@@ -39,34 +53,147 @@ func (g sparseGraph) Disconnect(head, tail int) {
 	}
 }
 
-func (g sparseGraph) Neighbors(head int) <-chan int {
-	if pred, ok := g[head]; ok {
-		c := make(chan int)
-		go func() {
-			for v := range pred {
-				c <- v
+func (g sparseGraph) Neighbors(head int, f func(tail int) bool) {
+	for v := range g[head] {
+		if !f(v) {
+			return
+		}
+	}
+}
+
+func (g sparseGraph) Degree(head int) int {
+	return len(g[head])
+}
+
+func (g sparseGraph) Edges(f func(head, tail int) bool) {
+	for head, vertices := range g {
+		for v := range vertices {
+			if !f(head, v) {
+				return
 			}
-			close(c)
-		}()
-		return c
+		}
 	}
-	return closed
 }
 
-// adjacency matrix with true O(1) connect/disconnect time
+// DenseGraphMaxVertex is the largest vertex identifier that graphs created by
+// NewDenseGraph store in adjacency matrix, which then takes up to 128 MiB.
+const DenseGraphMaxVertex = 1<<15 - 1
+
+// adjacency (bit) matrix with true O(1) connect/disconnect time,
+// it grows to fit the largest vertex connected so far
 type denseGraph struct {
 	bytes []byte
 	maxN  int
+
+	// edges with vertices that don't fit matrix
+	overflow sparseGraph
+}
+
+// NewDenseGraph returns Graph backed by adjacency bit matrix.
+// It's suited for dense graphs of compact, non-negative vertex identifiers,
+// as it takes n^2 bits of memory, where n is the largest vertex identifier.
+// Edges with negative vertices or vertices larger than DenseGraphMaxVertex
+// are stored in adjacency lists instead.
+func NewDenseGraph() Graph {
+	return &denseGraph{overflow: make(sparseGraph)}
+}
+
+func fitsDense(head, tail int) bool {
+	return head >= 0 && tail >= 0 && head <= DenseGraphMaxVertex && tail <= DenseGraphMaxVertex
+}
+
+// resize grows matrix (to the nearest power of 2) so that it fits n vertices,
+// n must not be larger than DenseGraphMaxVertex+1.
+func (g *denseGraph) resize(n int) {
+	if n <= g.maxN {
+		return
+	}
+	maxN := g.maxN
+	if maxN == 0 {
+		maxN = 8
+	}
+	for maxN < n {
+		maxN *= 2
+	}
+	rowSize, oldRowSize := maxN/8, g.maxN/8
+	bytes := make([]byte, maxN*rowSize)
+	for i := 0; i < g.maxN; i++ {
+		copy(bytes[i*rowSize:], g.bytes[i*oldRowSize:(i+1)*oldRowSize])
+	}
+	g.bytes = bytes
+	g.maxN = maxN
+}
+
+func (g *denseGraph) Connect(head, tail int) {
+	if !fitsDense(head, tail) {
+		g.overflow.Connect(head, tail)
+		return
+	}
+	if head >= tail {
+		g.resize(head + 1)
+	} else {
+		g.resize(tail + 1)
+	}
+	i := head*g.maxN + tail
+	g.bytes[i/8] |= 1 << uint(i%8)
+}
+
+func (g *denseGraph) Disconnect(head, tail int) {
+	if !fitsDense(head, tail) {
+		g.overflow.Disconnect(head, tail)
+		return
+	}
+	if head >= g.maxN || tail >= g.maxN {
+		return
+	}
+	i := head*g.maxN + tail
+	g.bytes[i/8] &^= 1 << uint(i%8)
 }
 
-func (g denseGraph) resize(n int) {
-	// TODO: implement
+// row returns bit vector of vertex head successors.
+func (g *denseGraph) row(head int) []byte {
+	if head < 0 || head >= g.maxN {
+		return nil
+	}
+	rowSize := g.maxN / 8
+	return g.bytes[head*rowSize : (head+1)*rowSize]
+}
+
+func (g *denseGraph) Neighbors(head int, f func(tail int) bool) {
+	for i, b := range g.row(head) {
+		for j := 0; b != 0; j++ {
+			if b&1 != 0 && !f(i*8+j) {
+				return
+			}
+			b >>= 1
+		}
+	}
+	g.overflow.Neighbors(head, f)
 }
 
-func (g denseGraph) Connect(head, tail int) {
-	// TODO: implement
+func (g *denseGraph) Degree(head int) int {
+	n := 0
+	for _, b := range g.row(head) {
+		for ; b != 0; b &= b - 1 {
+			n++
+		}
+	}
+	return n + g.overflow.Degree(head)
 }
 
-func (g denseGraph) Disconnect(head, tail int) {
-	// TODO: implement
+func (g *denseGraph) Edges(f func(head, tail int) bool) {
+	more := true
+	for head := 0; more && head < g.maxN; head++ {
+		for i, b := range g.row(head) {
+			for j := 0; more && b != 0; j++ {
+				if b&1 != 0 {
+					more = f(head, i*8+j)
+				}
+				b >>= 1
+			}
+		}
+	}
+	if more {
+		g.overflow.Edges(f)
+	}
 }
@@ -0,0 +1,224 @@
+package router
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func neighbors(g Graph, head int) []int {
+	var vs []int
+	g.Neighbors(head, func(v int) bool {
+		vs = append(vs, v)
+		return true
+	})
+	sort.Ints(vs)
+	return vs
+}
+
+func TestGraphs(t *testing.T) {
+	for name, newGraph := range Graphs {
+		g := newGraph()
+		g.Connect(1, 2)
+		g.Connect(1, 3)
+		g.Connect(3, 1)
+		g.Connect(1, 100) // grows dense graph
+		g.Connect(100, 7)
+		g.Connect(1, 2) // NOOP
+		for _, testCase := range []struct {
+			head int
+			want []int
+		}{
+			{1, []int{2, 3, 100}},
+			{2, nil},
+			{3, []int{1}},
+			{100, []int{7}},
+			{1000, nil},
+			{-1, nil},
+		} {
+			if have := neighbors(g, testCase.head); !reflect.DeepEqual(have, testCase.want) {
+				t.Errorf("%s: Neighbors(%d) = %v, want %v", name, testCase.head, have, testCase.want)
+			}
+			if have := g.Degree(testCase.head); have != len(testCase.want) {
+				t.Errorf("%s: Degree(%d) = %d, want %d", name, testCase.head, have, len(testCase.want))
+			}
+		}
+
+		var edges [][2]int
+		g.Edges(func(head, tail int) bool {
+			edges = append(edges, [2]int{head, tail})
+			return true
+		})
+		sort.Slice(edges, func(i, j int) bool {
+			return edges[i][0] < edges[j][0] || (edges[i][0] == edges[j][0] && edges[i][1] < edges[j][1])
+		})
+		if want := [][2]int{{1, 2}, {1, 3}, {1, 100}, {3, 1}, {100, 7}}; !reflect.DeepEqual(edges, want) {
+			t.Errorf("%s: Edges = %v, want %v", name, edges, want)
+		}
+
+		n := 0
+		g.Neighbors(1, func(int) bool {
+			n++
+			return false
+		})
+		if n != 1 {
+			t.Errorf("%s: Neighbors should stop iteration when f returns false", name)
+		}
+		n = 0
+		g.Edges(func(int, int) bool {
+			n++
+			return false
+		})
+		if n != 1 {
+			t.Errorf("%s: Edges should stop iteration when f returns false", name)
+		}
+
+		g.Disconnect(1, 3)
+		g.Disconnect(1, 100)
+		g.Disconnect(3, 2)    // NOOP
+		g.Disconnect(1000, 1) // NOOP
+		if have, want := neighbors(g, 1), []int{2}; !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: Neighbors(1) = %v, want %v after Disconnect", name, have, want)
+		}
+		if have, want := neighbors(g, 3), []int{1}; !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: Neighbors(3) = %v, want %v after Disconnect", name, have, want)
+		}
+	}
+}
+
+func TestDenseGraphLargeVertices(t *testing.T) {
+	g := NewDenseGraph()
+	huge := 1 << 40
+	g.Connect(1, huge)
+	g.Connect(1, 2)
+	g.Connect(huge, 3)
+	g.Connect(-1, 4)
+	g.Connect(DenseGraphMaxVertex, DenseGraphMaxVertex+1)
+	if maxN := g.(*denseGraph).maxN; maxN != 8 {
+		t.Errorf("matrix fits %d vertices, want 8", maxN)
+	}
+	for _, testCase := range []struct {
+		head int
+		want []int
+	}{
+		{1, []int{2, huge}},
+		{huge, []int{3}},
+		{-1, []int{4}},
+		{DenseGraphMaxVertex, []int{DenseGraphMaxVertex + 1}},
+	} {
+		if have := neighbors(g, testCase.head); !reflect.DeepEqual(have, testCase.want) {
+			t.Errorf("Neighbors(%d) = %v, want %v", testCase.head, have, testCase.want)
+		}
+		if have := g.Degree(testCase.head); have != len(testCase.want) {
+			t.Errorf("Degree(%d) = %d, want %d", testCase.head, have, len(testCase.want))
+		}
+	}
+	n := 0
+	g.Edges(func(int, int) bool {
+		n++
+		return true
+	})
+	if n != 5 {
+		t.Errorf("Edges visited %d edges, want 5", n)
+	}
+	g.Disconnect(1, huge)
+	if have, want := neighbors(g, 1), []int{2}; !reflect.DeepEqual(have, want) {
+		t.Errorf("Neighbors(1) = %v, want %v after Disconnect", have, want)
+	}
+}
+
+func TestRouterWithGraph(t *testing.T) {
+	for name, newGraph := range Graphs {
+		g := newRouter(t, true, WithGraph(newGraph), WithShards(1))
+		c := make(chan []byte, 1)
+		g.Follow(1, 2)
+		u, _, _ := g.Subscribe(1, c)
+		g.SendMsgToFollowers(2, []byte("msg"))
+		if len(c) != 1 {
+			t.Errorf("%s: follower should receive a message", name)
+		}
+		u()
+		g.Reset()
+		c = make(chan []byte, 1)
+		g.Subscribe(1, c)
+		g.SendMsgToFollowers(2, []byte("msg"))
+		if len(c) != 0 {
+			t.Errorf("%s: Reset should remove all the connections", name)
+		}
+	}
+}
+
+const benchUsers = 1000
+
+func benchmarkGraphs(b *testing.B, f func(b *testing.B, newGraph func() Graph)) {
+	for _, name := range []string{"sparse", "dense"} {
+		newGraph := Graphs[name]
+		b.Run(name, func(b *testing.B) {
+			f(b, newGraph)
+		})
+	}
+}
+
+func BenchmarkRouterFollow(b *testing.B) {
+	benchmarkGraphs(b, func(b *testing.B, newGraph func() Graph) {
+		g := newRouter(b, false, WithGraph(newGraph), WithShards(1))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			g.Follow(i%benchUsers, (i/benchUsers)%benchUsers)
+		}
+	})
+}
+
+func BenchmarkRouterUnfollow(b *testing.B) {
+	benchmarkGraphs(b, func(b *testing.B, newGraph func() Graph) {
+		g := newRouter(b, false, WithGraph(newGraph), WithShards(1))
+		for i := 0; i < benchUsers*benchUsers; i++ {
+			g.Follow(i%benchUsers, i/benchUsers)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			g.Unfollow(i%benchUsers, (i/benchUsers)%benchUsers)
+		}
+	})
+}
+
+func BenchmarkGraphNeighbors(b *testing.B) {
+	for _, degree := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("degree=%d", degree), func(b *testing.B) {
+			benchmarkGraphs(b, func(b *testing.B, newGraph func() Graph) {
+				g := newGraph()
+				for i := 0; i < benchUsers; i++ {
+					for j := 0; j < degree; j++ {
+						g.Connect(i, (i+j*benchUsers/degree)%benchUsers)
+					}
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					g.Neighbors(i%benchUsers, func(int) bool { return true })
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkRouterSubscribe measures time spent holding Router's lock
+// by Subscribe and unsubscribe calls for users following degree others.
+func BenchmarkRouterSubscribe(b *testing.B) {
+	for _, degree := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("degree=%d", degree), func(b *testing.B) {
+			benchmarkGraphs(b, func(b *testing.B, newGraph func() Graph) {
+				g := newRouter(b, false, WithGraph(newGraph), WithShards(1))
+				for i := 0; i < degree; i++ {
+					g.Follow(0, i+1)
+				}
+				c := make(chan []byte)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					u, _, _ := g.Subscribe(0, c)
+					u()
+				}
+			})
+		})
+	}
+}
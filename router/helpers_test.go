@@ -0,0 +1,22 @@
+package router
+
+import "testing"
+
+// newRouter returns new Router, failing tb if it can't be created.
+func newRouter(tb testing.TB, blockingSend bool, opts ...Option) *Router {
+	g, err := New(blockingSend, opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return g
+}
+
+// received returns message queued in c, or "" if there's none.
+func received(c <-chan []byte) string {
+	select {
+	case m := <-c:
+		return string(m)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,108 @@
+package router
+
+import (
+	"sort"
+	"sync"
+)
+
+type historyMsg struct {
+	seq int64
+	msg []byte
+}
+
+// historyQueue keeps up to size latest messages.
+type historyQueue []historyMsg
+
+func (q historyQueue) push(m historyMsg, size int) historyQueue {
+	if len(q) >= size {
+		q[0] = historyMsg{}
+		q = q[1:]
+	}
+	return append(q, m)
+}
+
+// since returns index of the first message with sequence number greater than seq.
+func (q historyQueue) since(seq int64) int {
+	i := len(q)
+	for i > 0 && q[i-1].seq > seq {
+		i--
+	}
+	return i
+}
+
+// history keeps latest messages sent to each user (and broadcasts)
+// along with sequence numbers of events that sent them.
+// It's safe for concurrent use.
+type history struct {
+	mu         sync.Mutex
+	size       int
+	maxUsers   int // 0 means no limit
+	users      map[int]historyQueue
+	broadcasts historyQueue
+}
+
+func newHistory(size int) *history {
+	return &history{
+		size:  size,
+		users: make(map[int]historyQueue),
+	}
+}
+
+func (h *history) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.users = make(map[int]historyQueue)
+	h.broadcasts = nil
+}
+
+func (h *history) add(userID int, seq int64, msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	q, ok := h.users[userID]
+	if !ok && h.maxUsers > 0 && len(h.users) >= h.maxUsers {
+		h.evict()
+	}
+	h.users[userID] = q.push(historyMsg{seq, msg}, h.size)
+}
+
+// evict removes messages of a quarter (at least one) of users
+// that were sent messages least recently.
+func (h *history) evict() {
+	newest := make([]int64, 0, len(h.users))
+	for _, q := range h.users {
+		newest = append(newest, q[len(q)-1].seq)
+	}
+	sort.Slice(newest, func(i, j int) bool { return newest[i] < newest[j] })
+	cutoff := newest[(len(newest)-1)/4]
+	for id, q := range h.users {
+		if q[len(q)-1].seq <= cutoff {
+			delete(h.users, id)
+		}
+	}
+}
+
+func (h *history) addBroadcast(seq int64, msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.broadcasts = h.broadcasts.push(historyMsg{seq, msg}, h.size)
+}
+
+// since returns messages sent to userID (including broadcasts) by events
+// with sequence numbers greater than seq, in sequence order.
+func (h *history) since(userID int, seq int64) [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u, b := h.users[userID], h.broadcasts
+	u, b = u[u.since(seq):], b[b.since(seq):]
+	msgs := make([][]byte, 0, len(u)+len(b))
+	for len(u) > 0 || len(b) > 0 {
+		if len(b) == 0 || (len(u) > 0 && u[0].seq <= b[0].seq) {
+			msgs = append(msgs, u[0].msg)
+			u = u[1:]
+		} else {
+			msgs = append(msgs, b[0].msg)
+			b = b[1:]
+		}
+	}
+	return msgs
+}
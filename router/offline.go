@@ -0,0 +1,198 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// OfflineLimits bound offline message queue of a single user
+// (and the number of users with stored messages).
+// Zero value of any field means no limit.
+type OfflineLimits struct {
+	// MaxMessages is the maximum number of stored messages.
+	MaxMessages int
+	// MaxBytes is the maximum total size of stored messages.
+	MaxBytes int
+	// MaxAge is the maximum time a message is stored for. Users that
+	// have been offline for longer than that don't get broadcasts stored.
+	MaxAge time.Duration
+	// MaxUsers is the maximum number of users with stored messages,
+	// messages for other users are dropped once it's reached.
+	MaxUsers int
+}
+
+type offlineMsg struct {
+	msg []byte
+	t   time.Time
+}
+
+type offlineQueue struct {
+	msgs  []offlineMsg
+	bytes int
+}
+
+func (q *offlineQueue) popFront() {
+	q.bytes -= len(q.msgs[0].msg)
+	q.msgs[0] = offlineMsg{}
+	q.msgs = q.msgs[1:]
+}
+
+// offlineStore stores messages for users without subscribed channels.
+// It's safe for concurrent use.
+type offlineStore struct {
+	mu     sync.Mutex
+	limits OfflineLimits
+	queues map[int]*offlineQueue
+	// users that have subscribed at least once (recipients of broadcasts),
+	// mapped to the time they went offline (zero while online)
+	known map[int]time.Time
+	// number of subscribed channels of online users
+	online map[int]int
+	now    func() time.Time
+	// time expired messages and users were last removed
+	lastSweep time.Time
+}
+
+func newOfflineStore(limits OfflineLimits) *offlineStore {
+	return &offlineStore{
+		limits: limits,
+		queues: make(map[int]*offlineQueue),
+		known:  make(map[int]time.Time),
+		online: make(map[int]int),
+		now:    time.Now,
+	}
+}
+
+// expire removes messages older than MaxAge from the front of q.
+func (s *offlineStore) expire(q *offlineQueue, now time.Time) {
+	if s.limits.MaxAge <= 0 {
+		return
+	}
+	for len(q.msgs) > 0 && now.Sub(q.msgs[0].t) > s.limits.MaxAge {
+		q.popFront()
+	}
+}
+
+// sweep removes expired messages, queues left empty and users that have been
+// offline for longer than MaxAge, at most once per MaxAge, so that messages
+// and users that are never taken don't pile up.
+func (s *offlineStore) sweep(now time.Time) {
+	if s.limits.MaxAge <= 0 || now.Sub(s.lastSweep) < s.limits.MaxAge {
+		return
+	}
+	s.lastSweep = now
+	for id, q := range s.queues {
+		if s.expire(q, now); len(q.msgs) == 0 {
+			delete(s.queues, id)
+		}
+	}
+	for id, t := range s.known {
+		if !t.IsZero() && now.Sub(t) > s.limits.MaxAge {
+			delete(s.known, id)
+		}
+	}
+}
+
+// push appends msg to userID queue (unless it's online), dropping
+// the oldest messages when queue limits are exceeded.
+func (s *offlineStore) push(userID int, msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.online[userID] == 0 {
+		now := s.now()
+		s.sweep(now)
+		s.pushLocked(userID, msg, now)
+	}
+}
+
+// broadcast pushes msg to queues of all known users that are not online.
+func (s *offlineStore) broadcast(msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.sweep(now)
+	for id := range s.known {
+		if s.online[id] == 0 {
+			s.pushLocked(id, msg, now)
+		}
+	}
+}
+
+func (s *offlineStore) pushLocked(userID int, msg []byte, now time.Time) {
+	if s.limits.MaxBytes > 0 && len(msg) > s.limits.MaxBytes {
+		return
+	}
+	q, ok := s.queues[userID]
+	if !ok {
+		if s.limits.MaxUsers > 0 && len(s.queues) >= s.limits.MaxUsers {
+			return
+		}
+		q = &offlineQueue{}
+		s.queues[userID] = q
+	}
+	s.expire(q, now)
+	q.msgs = append(q.msgs, offlineMsg{msg, now})
+	q.bytes += len(msg)
+	for (s.limits.MaxMessages > 0 && len(q.msgs) > s.limits.MaxMessages) ||
+		(s.limits.MaxBytes > 0 && q.bytes > s.limits.MaxBytes) {
+		q.popFront()
+	}
+}
+
+// take removes and returns (not expired) messages stored for userID
+// and marks it as known and online user, until leave is called.
+func (s *offlineStore) take(userID int) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.known[userID] = time.Time{}
+	s.online[userID]++
+	q, ok := s.queues[userID]
+	if !ok {
+		return nil
+	}
+	delete(s.queues, userID)
+	s.expire(q, s.now())
+	msgs := make([][]byte, len(q.msgs))
+	for i, m := range q.msgs {
+		msgs[i] = m.msg
+	}
+	return msgs
+}
+
+// leave marks userID as offline, once it's called
+// for every call to take.
+func (s *offlineStore) leave(userID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.online[userID]--; s.online[userID] <= 0 {
+		delete(s.online, userID)
+		s.known[userID] = s.now()
+	}
+}
+
+// replay delivers stored messages to a newly subscribed channel,
+// queueing messages sent to it in the meantime.
+type replay struct {
+	mu       sync.Mutex
+	msgs     [][]byte
+	stop     chan struct{}
+	finished chan struct{}
+}
+
+func (r *replay) push(msg []byte) {
+	r.mu.Lock()
+	r.msgs = append(r.msgs, msg)
+	r.mu.Unlock()
+}
+
+func (r *replay) pop() ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.msgs) == 0 {
+		return nil, false
+	}
+	msg := r.msgs[0]
+	r.msgs[0] = nil
+	r.msgs = r.msgs[1:]
+	return msg, true
+}
@@ -0,0 +1,85 @@
+package router
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// sendJob is a message to be sent to a channel by sendPool worker.
+type sendJob struct {
+	c   chan<- []byte
+	msg []byte
+	wg  *sync.WaitGroup
+}
+
+// sendPool is a fixed set of goroutines sending messages to channels
+// that aren't ready to receive them, shared by all the blocking sends.
+type sendPool struct {
+	closed int32
+	jobs   chan sendJob // unbuffered, so that only idle workers take jobs
+	quit   chan struct{}
+}
+
+func newSendPool(workers int) *sendPool {
+	p := &sendPool{
+		jobs: make(chan sendJob),
+		quit: make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-p.jobs:
+					job.c <- job.msg
+					job.wg.Done()
+				case <-p.quit:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// send sends msg to all channels of s and returns once all of them
+// receive it. Channels that aren't ready are handed over to idle workers
+// or, if there are none, to goroutines started for them, so that sends
+// to slow channels don't hold up unrelated ones waiting for a worker.
+func (p *sendPool) send(msg []byte, s cSet) {
+	var (
+		wg   sync.WaitGroup
+		full []chan<- []byte
+	)
+	for c := range s {
+		select {
+		case c <- msg:
+		default:
+			full = append(full, c)
+		}
+	}
+	for i, c := range full {
+		if i == len(full)-1 {
+			// all the others are already being sent to concurrently
+			c <- msg
+			break
+		}
+		wg.Add(1)
+		select {
+		case p.jobs <- sendJob{c: c, msg: msg, wg: &wg}:
+		default:
+			go func(c chan<- []byte) {
+				c <- msg
+				wg.Done()
+			}(c)
+		}
+	}
+	wg.Wait()
+}
+
+// close stops workers once they finish their sends, subsequent
+// sends are made only by goroutines started for them.
+func (p *sendPool) close() {
+	if atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		close(p.quit)
+	}
+}
@@ -2,7 +2,9 @@ package router
 
 import (
 	"errors"
+	"runtime"
 	"sync"
+	"sync/atomic"
 
 	"github.com/telendt/fmaze/event"
 )
@@ -12,20 +14,30 @@ var (
 	// when client's send channel has been already subscribed.
 	ErrChannelAlreadySubscribed = errors.New("client already subscribed")
 
+	// ErrChannelNotSubscribed is returned by Router.SetSlowConsumerPolicy
+	// calls when client's send channel isn't subscribed.
+	ErrChannelNotSubscribed = errors.New("client not subscribed")
+
+	// ErrDenseGraphShards is returned by New when graphs created by
+	// NewDenseGraph are used with more than one shard.
+	ErrDenseGraphShards = errors.New("dense graph can't be used with more than one shard")
+
 	rt *Router
-	_  event.Actions = rt
+	_  event.Actions   = rt
+	_  event.Sequencer = rt
 )
 
-// cSet represents set of send channels and provides some utility methods.
-type cSet map[chan<- []byte]struct{}
+// cSet represents set of send channels (mapped to their connections)
+// and provides some utility methods.
+type cSet map[chan<- []byte]*conn
 
-func (s cSet) add(c chan<- []byte) {
-	s[c] = struct{}{}
+func (s cSet) add(c chan<- []byte, cn *conn) {
+	s[c] = cn
 }
 
 func (s cSet) extend(other cSet) {
-	for c := range other {
-		s.add(c)
+	for c, cn := range other {
+		s.add(c, cn)
 	}
 }
 
@@ -68,158 +80,813 @@ func (m cSetsMap) removeMembers(userID int, cset cSet) {
 	}
 }
 
+// Stats holds Router statistics.
+type Stats struct {
+	// Users is the number of distinct users with subscribed channels.
+	Users int
+	// Connections is the number of subscribed channels.
+	Connections int
+	// Dropped is the number of messages dropped by non-blocking sends
+	// (see SlowConsumerPolicy), except for ones dropped by DropOldest policy.
+	Dropped int64
+	// DroppedOldest is the number of queued messages dropped
+	// to make room for new ones by DropOldest policy.
+	DroppedOldest int64
+	// Disconnected is the number of channels disconnected by Disconnect policy.
+	Disconnected int64
+	// Queued is the number of messages waiting in fan-out queues
+	// (see WithAsyncFanout), counted once per worker they're queued to.
+	Queued int
+}
+
 // Router implements Actions interface.
+//
+// State of users (and groups) is split into shards by their identifiers,
+// each guarded by its own lock, so that sending messages to users of one
+// shard doesn't block actions on users of other shards. Every action
+// returns once its messages are sent (or queued), so messages sent
+// by subsequent actions are delivered in the order of these actions.
 type Router struct {
-	mu sync.RWMutex
+	// accessed atomically
+	dropped, users, connections int64
+	droppedOldest, disconnected int64
+	seq                         int64
+	replays                     int64 // len(replaying)
+
+	nShards   int
+	shards    []*shard
+	shardMask int
+
+	// subscribed channels
+	chansMu sync.Mutex
+	chans   map[chan<- []byte]*conn
+
+	sendToAll    func([]byte, cSet)
+	sendWorkers  int
+	sendPool     *sendPool // set only with blocking sends
+	onFanout     func(n int)
+	slowConsumer SlowConsumerPolicy
+
+	// set only with asynchronous fan-out enabled
+	fanoutWorkers, fanoutQueueSize int
+	fanout                         *fanout
+
+	newGraph func() Graph
+
+	offline         *offlineStore
+	history         *history
+	historyMaxUsers int
+
+	// set only with offline store or history enabled
+	replayMu  sync.Mutex
+	replaying map[chan<- []byte]*replay
+}
+
+// Option configures Router.
+type Option func(*Router)
+
+// WithGraph makes Router use graphs created by newGraph to store
+// follow relations (NewSparseGraph by default). Other relations are
+// always stored in graphs created by NewSparseGraph.
+func WithGraph(newGraph func() Graph) Option {
+	return func(g *Router) {
+		g.newGraph = newGraph
+	}
+}
+
+// WithShards makes Router split state of users into n shards (rounded up
+// to a power of 2, GOMAXPROCS if 0, the default). Every shard keeps its
+// own graphs, so graphs created by NewDenseGraph, taking memory proportional
+// to the largest vertex identifier, can be used only with one shard.
+func WithShards(n int) Option {
+	return func(g *Router) {
+		g.nShards = n
+	}
+}
 
-	// closed on reset
-	done chan struct{}
+// WithAsyncFanout makes Router queue messages to be sent by workers
+// goroutines, instead of sending them before actions return. Every worker
+// has a queue of up to queueSize messages and sends messages to users
+// whose identifiers map to it, so that messages are delivered to every user
+// in the order of actions, but a slow client holds up only users of its
+// worker. Actions block while queue they send to is full.
+func WithAsyncFanout(workers, queueSize int) Option {
+	return func(g *Router) {
+		if workers > 0 {
+			g.fanoutWorkers, g.fanoutQueueSize = workers, queueSize
+		}
+	}
+}
 
-	sendToAll func([]byte, cSet)
+// WithSendWorkers makes blocking sends use up to n goroutines (GOMAXPROCS
+// if 0, the default, and none if negative) to send messages to channels that
+// aren't ready to receive them. When none of them is idle, goroutines are
+// started for such sends. It has no effect on non-blocking sends.
+func WithSendWorkers(n int) Option {
+	return func(g *Router) {
+		g.sendWorkers = n
+	}
+}
 
-	connectedClients   cSetsMap
-	connectedFollowers cSetsMap
-	allConnected       cSet
+// WithSlowConsumerPolicy makes non-blocking sends handle channels
+// that are full according to p (DropNewest policy by default),
+// unless they're given their own policy with SetSlowConsumerPolicy.
+// It has no effect on blocking sends.
+func WithSlowConsumerPolicy(p SlowConsumerPolicy) Option {
+	return func(g *Router) {
+		g.slowConsumer = p
+	}
+}
 
-	// inverted connection graph
-	invGraph Graph
+// WithFanoutObserver makes Router call f with the number
+// of recipients of every message sent.
+func WithFanoutObserver(f func(n int)) Option {
+	return func(g *Router) {
+		g.onFanout = f
+	}
 }
 
-// New returns new Router.
-func New(blockingSend bool) *Router {
+// WithOfflineStore makes Router store messages for users that have no
+// subscribed channels (bounded by limits) and deliver them to the first
+// channel subscribed for that user, before any other message.
+// Broadcasts are stored only for users that have subscribed before.
+func WithOfflineStore(limits OfflineLimits) Option {
+	return func(g *Router) {
+		g.offline = newOfflineStore(limits)
+	}
+}
+
+// WithHistory makes Router keep up to size latest messages sent to each user
+// and size latest broadcasts, along with sequence numbers of events that sent them
+// (see SetSeq), so that resuming clients can catch up with SubscribeFrom.
+func WithHistory(size int) Option {
+	return func(g *Router) {
+		if size > 0 {
+			g.history = newHistory(size)
+		}
+	}
+}
+
+// WithHistoryMaxUsers limits history (see WithHistory) to messages of up to
+// n users (no limit by default). Once there are more, messages of a quarter
+// of users that were sent messages least recently are removed, so their
+// resuming clients get only broadcasts they missed.
+func WithHistoryMaxUsers(n int) Option {
+	return func(g *Router) {
+		g.historyMaxUsers = n
+	}
+}
+
+// New returns new Router. It returns ErrDenseGraphShards
+// if graphs created by NewDenseGraph are used with more than one shard.
+func New(blockingSend bool, opts ...Option) (*Router, error) {
+	g := &Router{
+		chans:    make(map[chan<- []byte]*conn),
+		newGraph: NewSparseGraph,
+	}
 	f := func(msg []byte, s cSet) {
-		for c := range s {
-			select {
-			case c <- msg:
-			default:
-			}
+		for c, cn := range s {
+			g.trySend(c, cn, msg)
 		}
 	}
 	if blockingSend {
 		f = func(msg []byte, s cSet) {
-			switch l := len(s); {
-			case l == 1:
-				for c := range s {
-					c <- msg
-				}
-			case l > 1:
-				var wg sync.WaitGroup
-				for c := range s {
-					wg.Add(1)
-					go func(c chan<- []byte) {
-						defer wg.Done()
-						c <- msg
-					}(c)
+			g.sendPool.send(msg, s)
+		}
+	}
+
+	g.sendToAll = f
+	for _, opt := range opts {
+		opt(g)
+	}
+	n := g.nShards
+	if n == 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	size := 1
+	for size < n {
+		size *= 2
+	}
+	if _, dense := g.newGraph().(*denseGraph); dense && size > 1 {
+		return nil, ErrDenseGraphShards
+	}
+	g.shards = make([]*shard, size)
+	if blockingSend {
+		workers := g.sendWorkers
+		if workers == 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		g.sendPool = newSendPool(workers)
+	}
+	if g.fanoutWorkers > 0 {
+		g.fanout = newFanout(g.fanoutWorkers, g.fanoutQueueSize, f)
+		g.sendToAll = g.fanout.send
+	}
+	if g.history != nil {
+		g.history.maxUsers = g.historyMaxUsers
+	}
+	full := g.offline != nil || g.history != nil
+	if full {
+		g.replaying = make(map[chan<- []byte]*replay)
+		send := g.sendToAll
+		g.sendToAll = func(msg []byte, s cSet) {
+			if atomic.LoadInt64(&g.replays) == 0 {
+				send(msg, s)
+				return
+			}
+			live := make(cSet, len(s))
+			g.replayMu.Lock()
+			for c, cn := range s {
+				if r, ok := g.replaying[c]; ok {
+					r.push(msg)
+				} else {
+					live.add(c, cn)
 				}
-				wg.Wait()
-			default: // l == 0
 			}
+			g.replayMu.Unlock()
+			send(msg, live)
+		}
+	}
+	if g.onFanout != nil {
+		send := g.sendToAll
+		g.sendToAll = func(msg []byte, s cSet) {
+			g.onFanout(len(s))
+			send(msg, s)
 		}
 	}
+	g.shardMask = len(g.shards) - 1
+	for i := range g.shards {
+		g.shards[i] = newShard()
+		g.shards[i].resetGraphs(g.newGraph, full)
+	}
+	return g, nil
+}
+
+// replay sends messages of r to c until there are no more
+// messages to send or it's unsubscribed.
+func (g *Router) replay(c chan<- []byte, r *replay) {
+	defer close(r.finished)
+	for {
+		msg, ok := r.pop()
+		if !ok {
+			g.replayMu.Lock()
+			// no messages can be pushed to r while g.replayMu is locked
+			msg, ok = r.pop()
+			if !ok && g.replaying[c] == r {
+				delete(g.replaying, c)
+				atomic.AddInt64(&g.replays, -1)
+			}
+			g.replayMu.Unlock()
+			if !ok {
+				return
+			}
+		}
+		select {
+		case c <- msg:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Close stops goroutines started by Router, once messages queued
+// for fan-out are sent. Messages sent after Close are sent by goroutines
+// that send them or, if channels aren't ready, goroutines started for them.
+func (g *Router) Close() {
+	// fan-out workers send with send workers, so they're stopped first
+	if g.fanout != nil {
+		g.fanout.close()
+	}
+	if g.sendPool != nil {
+		g.sendPool.close()
+	}
+}
+
+// SetSlowConsumerPolicy makes non-blocking sends handle subscribed channel c
+// according to p, instead of policy set with WithSlowConsumerPolicy,
+// once it's full. It returns ErrChannelNotSubscribed if c isn't subscribed.
+func (g *Router) SetSlowConsumerPolicy(c chan<- []byte, p SlowConsumerPolicy) error {
+	g.chansMu.Lock()
+	defer g.chansMu.Unlock()
+	cn, ok := g.chans[c]
+	if !ok {
+		return ErrChannelNotSubscribed
+	}
+	cn.policy.Store(&p)
+	return nil
+}
 
-	return &Router{
-		done:               make(chan struct{}),
-		sendToAll:          f,
-		connectedClients:   make(cSetsMap),
-		connectedFollowers: make(cSetsMap),
-		allConnected:       make(cSet),
-		invGraph:           make(sparseGraph),
+// DisconnectNotice returns SlowConsumerPolicy.Notice of subscribed channel c
+// has been disconnected by Disconnect policy, and nil otherwise. Notice isn't
+// sent to c, as it may not have room for it, and should be sent to client
+// by subscriber once it stops receiving from c.
+func (g *Router) DisconnectNotice(c chan<- []byte) []byte {
+	g.chansMu.Lock()
+	cn, ok := g.chans[c]
+	g.chansMu.Unlock()
+	if !ok || atomic.LoadInt32(&cn.kicked) == 0 {
+		return nil
 	}
+	return cn.policy.Load().(*SlowConsumerPolicy).Notice
 }
 
-// Reset resets inverted connections graph.
+// Stats returns Router statistics.
+func (g *Router) Stats() Stats {
+	stats := Stats{
+		Users:       int(atomic.LoadInt64(&g.users)),
+		Connections: int(atomic.LoadInt64(&g.connections)),
+		Dropped:     atomic.LoadInt64(&g.dropped),
+
+		DroppedOldest: atomic.LoadInt64(&g.droppedOldest),
+		Disconnected:  atomic.LoadInt64(&g.disconnected),
+	}
+	if g.fanout != nil {
+		stats.Queued = g.fanout.queued()
+	}
+	return stats
+}
+
+// SetSeq sets sequence number of the event whose messages are going
+// to be sent next. It's used to record messages in history.
+func (g *Router) SetSeq(seq int64) {
+	atomic.StoreInt64(&g.seq, seq)
+}
+
+// allShards returns set of all shards.
+func (g *Router) allShards() shardSet {
+	s := make(shardSet, len(g.shards))
+	for i := range s {
+		s[i] = i
+	}
+	return s
+}
+
+// Reset resets inverted connections graph, block relation,
+// group memberships (and messages history).
 func (g *Router) Reset() {
-	g.mu.Lock()
-	defer g.mu.Unlock()
-	close(g.done)
-	g.done = make(chan struct{})
-	g.invGraph = make(sparseGraph)
+	all := g.allShards()
+	g.lockShards(all)
+	defer g.unlockShards(all)
+	for _, sh := range g.shards {
+		for _, cn := range sh.allConnected {
+			cn.close()
+		}
+		sh.resetGraphs(g.newGraph, sh.graph != nil)
+	}
+	if g.history != nil {
+		g.history.reset()
+	}
+	atomic.StoreInt64(&g.seq, 0)
 }
 
-// Subscribe adds user client (its send channel) to Router and returns UnsubscribeFunc.
+// Subscribe adds user client (its send channel) to Router and returns UnsubscribeFunc
+// and channel that's closed on Reset or when c is disconnected by Disconnect policy.
 // It also returns ErrChannelAlreadySubscribed if the channel has already been subsribed to any userID.
 // Given channel can only subscribe to a single userID, but it's fine to subscribe
-// multiple different channels under the same userID.
+// multiple different channels under the same userID. Router can't drop messages
+// queued in c, so DropOldest policy drops the message being sent instead
+// (see SubscribeWithPolicy).
 func (g *Router) Subscribe(userID int, c chan<- []byte) (UnsubscribeFunc, <-chan struct{}, error) {
-	g.mu.Lock()
-	defer g.mu.Unlock()
+	return g.subscribe(userID, c, nil, &g.slowConsumer, g.offlineBacklog(userID))
+}
 
-	if _, ok := g.allConnected[c]; ok {
-		return nil, g.done, ErrChannelAlreadySubscribed
-	}
-	g.connectedClients.getOrCreate(userID).add(c)
-	for id := range g.invGraph.Neighbors(userID) {
-		g.connectedFollowers.getOrCreate(id).add(c)
+// SubscribeWithPolicy works like Subscribe, but non-blocking sends handle c
+// according to p, instead of Router's SlowConsumerPolicy (see also
+// SetSlowConsumerPolicy). Router receives from c only to drop queued messages.
+func (g *Router) SubscribeWithPolicy(userID int, c chan []byte, p SlowConsumerPolicy) (UnsubscribeFunc, <-chan struct{}, error) {
+	return g.subscribe(userID, c, c, &p, g.offlineBacklog(userID))
+}
+
+// offlineBacklog returns backlog of messages stored for userID in offline store.
+func (g *Router) offlineBacklog(userID int) func() [][]byte {
+	return func() [][]byte {
+		if g.offline != nil {
+			return g.offline.take(userID)
+		}
+		return nil
 	}
-	g.allConnected.add(c)
+}
 
-	ig := g.invGraph
+// SubscribeFrom works like Subscribe, but first sends to c all the messages
+// from history (see WithHistory) that userID was sent by events with
+// sequence numbers greater than lastSeq. Messages sent in the meantime
+// are delivered after them, so there's neither a gap nor a duplicate.
+// Messages stored for userID in offline store are discarded.
+// Without history enabled it's equivalent to Subscribe, but like
+// SubscribeWithPolicy Router receives from c to drop queued messages.
+func (g *Router) SubscribeFrom(userID int, lastSeq int64, c chan []byte) (UnsubscribeFunc, <-chan struct{}, error) {
+	if g.history == nil {
+		return g.subscribe(userID, c, c, &g.slowConsumer, g.offlineBacklog(userID))
+	}
+	return g.subscribe(userID, c, c, &g.slowConsumer, func() [][]byte {
+		if g.offline != nil {
+			g.offline.take(userID)
+		}
+		return g.history.since(userID, lastSeq)
+	})
+}
 
-	cleanup := func() {
-		g.connectedClients.removeMember(userID, c)
-		for id := range ig.Neighbors(userID) {
-			g.connectedFollowers.removeMember(id, c)
+// subscribe subscribes c (received from as recv, if not nil) with policy p
+// and replays messages returned by backlog, which is called with shards
+// of userID (and users it follows) locked.
+func (g *Router) subscribe(userID int, c chan<- []byte, recv <-chan []byte, p *SlowConsumerPolicy, backlog func() [][]byte) (UnsubscribeFunc, <-chan struct{}, error) {
+	cn := newConn(userID, recv, p)
+	g.chansMu.Lock()
+	if _, ok := g.chans[c]; ok {
+		g.chansMu.Unlock()
+		return nil, nil, ErrChannelAlreadySubscribed
+	}
+	g.chans[c] = cn
+	g.chansMu.Unlock()
+
+	var ig, igr Graph
+	locked := g.lockUser(userID, func(sh *shard) (Graph, Graph) {
+		return sh.invGraph, sh.invGroups
+	})
+	defer g.unlockShards(locked)
+
+	sh := g.shardOf(userID)
+	if _, ok := sh.connectedClients[userID]; !ok {
+		atomic.AddInt64(&g.users, 1)
+	}
+	sh.connectedClients.getOrCreate(userID).add(c, cn)
+	ig, igr = sh.invGraph, sh.invGroups
+	ig.Neighbors(userID, func(id int) bool {
+		g.shardOf(id).connectedFollowers.getOrCreate(id).add(c, cn)
+		return true
+	})
+	igr.Neighbors(userID, func(id int) bool {
+		g.shardOf(id).connectedMembers.getOrCreate(id).add(c, cn)
+		return true
+	})
+	sh.allConnected.add(c, cn)
+	atomic.AddInt64(&g.connections, 1)
+	if msgs := backlog(); len(msgs) > 0 {
+		r := &replay{
+			msgs:     msgs,
+			stop:     make(chan struct{}),
+			finished: make(chan struct{}),
 		}
-		delete(g.allConnected, c)
+		g.replayMu.Lock()
+		g.replaying[c] = r
+		atomic.AddInt64(&g.replays, 1)
+		g.replayMu.Unlock()
+		go g.replay(c, r)
 	}
 
-	return func() {
-		g.mu.Lock()
-		defer g.mu.Unlock()
+	cleanup := func() *replay {
+		locked := g.lockUser(userID, func(*shard) (Graph, Graph) {
+			return ig, igr
+		})
+		defer g.unlockShards(locked)
 
-		if cleanup != nil {
-			cleanup()
-			cleanup = nil
+		sh.connectedClients.removeMember(userID, c)
+		if _, ok := sh.connectedClients[userID]; !ok {
+			atomic.AddInt64(&g.users, -1)
+		}
+		ig.Neighbors(userID, func(id int) bool {
+			g.shardOf(id).connectedFollowers.removeMember(id, c)
+			return true
+		})
+		igr.Neighbors(userID, func(id int) bool {
+			g.shardOf(id).connectedMembers.removeMember(id, c)
+			return true
+		})
+		delete(sh.allConnected, c)
+		atomic.AddInt64(&g.connections, -1)
+		if g.offline != nil {
+			g.offline.leave(userID)
+		}
+
+		g.chansMu.Lock()
+		delete(g.chans, c)
+		g.chansMu.Unlock()
+
+		if g.replaying == nil {
+			return nil
+		}
+		g.replayMu.Lock()
+		defer g.replayMu.Unlock()
+		if r, ok := g.replaying[c]; ok {
+			delete(g.replaying, c)
+			atomic.AddInt64(&g.replays, -1)
+			close(r.stop)
+			return r
 		}
-	}, g.done, nil
+		return nil
+	}
+
+	var once sync.Once
+	return func() {
+		// make sure nothing is sent to c after unsubscribe returns
+		// (concurrent calls wait for the first one to finish)
+		once.Do(func() {
+			if r := cleanup(); r != nil {
+				<-r.finished
+			}
+			if g.fanout != nil {
+				// c can't be queued anymore, wait for messages queued before
+				g.fanout.wait(userID)
+			}
+		})
+	}, cn.done, nil
 }
 
 // Follow adds followerID to list of followers of user identified by followedID.
 func (g *Router) Follow(followerID, followedID int) {
-	g.mu.Lock()
-	defer g.mu.Unlock()
+	fs, ds := g.lock2(followerID, followedID)
+	defer unlock2(fs, ds)
 
-	g.invGraph.Connect(followerID, followedID)
-	if conns, ok := g.connectedClients[followerID]; ok {
-		g.connectedFollowers.getOrCreate(followedID).extend(conns)
+	fs.invGraph.Connect(followerID, followedID)
+	if ds.graph != nil {
+		ds.graph.Connect(followedID, followerID)
+	}
+	if conns, ok := fs.connectedClients[followerID]; ok {
+		ds.connectedFollowers.getOrCreate(followedID).extend(conns)
 	}
 }
 
 // Unfollow removes followerID from list of followers of user identified by followedID.
 func (g *Router) Unfollow(followerID, followedID int) {
-	g.mu.Lock()
-	defer g.mu.Unlock()
+	fs, ds := g.lock2(followerID, followedID)
+	defer unlock2(fs, ds)
+
+	fs.invGraph.Disconnect(followerID, followedID)
+	if ds.graph != nil {
+		ds.graph.Disconnect(followedID, followerID)
+	}
+	if conns, ok := fs.connectedClients[followerID]; ok {
+		ds.connectedFollowers.removeMembers(followedID, conns)
+	}
+}
+
+// Follow represents follow relation between two users.
+type Follow struct {
+	FollowerID, FollowedID int
+}
+
+// Follows returns all the follow relations (in unspecified order).
+func (g *Router) Follows() []Follow {
+	var follows []Follow
+	for _, sh := range g.shards {
+		sh.mu.RLock()
+		sh.invGraph.Edges(func(followerID, followedID int) bool {
+			follows = append(follows, Follow{followerID, followedID})
+			return true
+		})
+		sh.mu.RUnlock()
+	}
+	return follows
+}
+
+// Join adds userID to members of group identified by groupID.
+func (g *Router) Join(userID, groupID int) {
+	us, gs := g.lock2(userID, groupID)
+	defer unlock2(us, gs)
+
+	us.invGroups.Connect(userID, groupID)
+	if gs.groups != nil {
+		gs.groups.Connect(groupID, userID)
+	}
+	if conns, ok := us.connectedClients[userID]; ok {
+		gs.connectedMembers.getOrCreate(groupID).extend(conns)
+	}
+}
+
+// Leave removes userID from members of group identified by groupID.
+func (g *Router) Leave(userID, groupID int) {
+	us, gs := g.lock2(userID, groupID)
+	defer unlock2(us, gs)
+
+	us.invGroups.Disconnect(userID, groupID)
+	if gs.groups != nil {
+		gs.groups.Disconnect(groupID, userID)
+	}
+	if conns, ok := us.connectedClients[userID]; ok {
+		gs.connectedMembers.removeMembers(groupID, conns)
+	}
+}
+
+// Membership represents group membership of a user.
+type Membership struct {
+	UserID, GroupID int
+}
+
+// Memberships returns all the group memberships (in unspecified order).
+func (g *Router) Memberships() []Membership {
+	var members []Membership
+	for _, sh := range g.shards {
+		sh.mu.RLock()
+		sh.invGroups.Edges(func(userID, groupID int) bool {
+			members = append(members, Membership{userID, groupID})
+			return true
+		})
+		sh.mu.RUnlock()
+	}
+	return members
+}
+
+// Block makes blockerID stop receiving messages sent by blockedID.
+func (g *Router) Block(blockerID, blockedID int) {
+	sh := g.shardOf(blockedID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	g.invGraph.Disconnect(followerID, followedID)
-	if conns, ok := g.connectedClients[followerID]; ok {
-		g.connectedFollowers.removeMembers(followedID, conns)
+	sh.invBlocks.Connect(blockedID, blockerID)
+}
+
+// Unblock makes blockerID receive messages sent by blockedID again.
+func (g *Router) Unblock(blockerID, blockedID int) {
+	sh := g.shardOf(blockedID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.invBlocks.Disconnect(blockedID, blockerID)
+}
+
+// Block represents block relation between two users.
+type Block struct {
+	BlockerID, BlockedID int
+}
+
+// Blocks returns all the block relations (in unspecified order).
+func (g *Router) Blocks() []Block {
+	var blocks []Block
+	for _, sh := range g.shards {
+		sh.mu.RLock()
+		sh.invBlocks.Edges(func(blockedID, blockerID int) bool {
+			blocks = append(blocks, Block{blockerID, blockedID})
+			return true
+		})
+		sh.mu.RUnlock()
+	}
+	return blocks
+}
+
+// blockers returns users that block senderID (nil if there are none).
+func (g *Router) blockers(senderID int) map[int]struct{} {
+	sh := g.shardOf(senderID)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	if sh.invBlocks.Degree(senderID) == 0 {
+		return nil
 	}
+	blockers := make(map[int]struct{})
+	sh.invBlocks.Neighbors(senderID, func(id int) bool {
+		blockers[id] = struct{}{}
+		return true
+	})
+	return blockers
 }
 
-// SendMsg sends message msg to connected clients registered with userID identifier.
-func (g *Router) SendMsg(userID int, msg []byte) {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
+// blocks reports whether userID blocks senderID.
+func (g *Router) blocks(userID, senderID int) (blocked bool) {
+	sh := g.shardOf(senderID)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	sh.invBlocks.Neighbors(senderID, func(id int) bool {
+		blocked = id == userID
+		return !blocked
+	})
+	return blocked
+}
+
+// SendMsg sends message msg sent by senderID to connected clients registered
+// with userID identifier, unless userID blocks senderID.
+func (g *Router) SendMsg(senderID, userID int, msg []byte) {
+	if g.blocks(userID, senderID) {
+		return
+	}
+	sh := g.shardOf(userID)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	if conns, ok := sh.connectedClients[userID]; ok {
+		g.sendToAll(msg, conns)
+	} else if g.offline != nil {
+		g.offline.push(userID, msg)
+	}
+	if g.history != nil {
+		g.history.add(userID, atomic.LoadInt64(&g.seq), msg)
+	}
+}
+
+// SendMsgToUsers sends message msg sent by senderID to connected clients
+// registered with any of userIDs identifiers (that don't block senderID).
+// Every client receives the message once, even if its userID is repeated.
+func (g *Router) SendMsgToUsers(senderID int, userIDs []int, msg []byte) {
+	blockers := g.blockers(senderID)
+	users := make(map[int]struct{}, len(userIDs))
+	var locked shardSet
+	for _, id := range userIDs {
+		if _, ok := blockers[id]; ok {
+			continue
+		}
+		users[id] = struct{}{}
+		locked = locked.add(g.shardIndex(id))
+	}
+	g.rlockShards(locked)
+	defer g.runlockShards(locked)
 
-	if conns, ok := g.connectedClients[userID]; ok {
+	conns := make(cSet)
+	for id := range users {
+		conns.extend(g.shardOf(id).connectedClients[id])
+	}
+	if len(conns) > 0 {
 		g.sendToAll(msg, conns)
 	}
+	if g.offline != nil || g.history != nil {
+		seq := atomic.LoadInt64(&g.seq)
+		for id := range users {
+			if g.offline != nil {
+				g.offline.push(id, msg)
+			}
+			if g.history != nil {
+				g.history.add(id, seq, msg)
+			}
+		}
+	}
 }
 
-// SendMsgToFollowers sends message msg to connected followers of user identified by userID.
+// SendMsgToFollowers sends message msg to connected followers of user identified
+// by userID, except for the ones that block userID.
 func (g *Router) SendMsgToFollowers(userID int, msg []byte) {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
+	blockers := g.blockers(userID)
+	sh := g.shardOf(userID)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	g.multicast(msg, blockers, sh.connectedFollowers[userID], func(f func(id int) bool) {
+		sh.graph.Neighbors(userID, f)
+	})
+}
+
+// SendMsgToGroup sends message msg sent by senderID to connected members
+// of group identified by groupID, except for the ones that block senderID.
+func (g *Router) SendMsgToGroup(senderID, groupID int, msg []byte) {
+	blockers := g.blockers(senderID)
+	sh := g.shardOf(groupID)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	g.multicast(msg, blockers, sh.connectedMembers[groupID], func(f func(id int) bool) {
+		sh.groups.Neighbors(groupID, f)
+	})
+}
 
-	if conns, ok := g.connectedFollowers[userID]; ok {
+// multicast sends message msg to conns and, with offline store or history
+// enabled, stores it for recipients (users passed to f), skipping blockers.
+// It must be called with shard holding conns (and recipients) locked for reading.
+func (g *Router) multicast(msg []byte, blockers map[int]struct{}, conns cSet, recipients func(f func(id int) bool)) {
+	if len(blockers) > 0 && len(conns) > 0 {
+		filtered := make(cSet, len(conns))
+		for c, cn := range conns {
+			if _, ok := blockers[cn.userID]; !ok {
+				filtered.add(c, cn)
+			}
+		}
+		conns = filtered
+	}
+	if len(conns) > 0 {
 		g.sendToAll(msg, conns)
 	}
+	if g.offline != nil || g.history != nil {
+		seq := atomic.LoadInt64(&g.seq)
+		recipients(func(id int) bool {
+			if _, ok := blockers[id]; ok {
+				return true
+			}
+			if g.offline != nil {
+				g.offline.push(id, msg)
+			}
+			if g.history != nil {
+				g.history.add(id, seq, msg)
+			}
+			return true
+		})
+	}
 }
 
 // Broadcast sends message msg to all connected users.
 func (g *Router) Broadcast(msg []byte) {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
-
-	g.sendToAll(msg, g.allConnected)
+	all := g.allShards()
+	g.rlockShards(all)
+	defer g.runlockShards(all)
+
+	conns := g.shards[0].allConnected
+	if len(g.shards) > 1 {
+		conns = make(cSet, atomic.LoadInt64(&g.connections))
+		for _, sh := range g.shards {
+			conns.extend(sh.allConnected)
+		}
+	}
+	g.sendToAll(msg, conns)
+	if g.offline != nil {
+		g.offline.broadcast(msg)
+	}
+	if g.history != nil {
+		g.history.addBroadcast(atomic.LoadInt64(&g.seq), msg)
+	}
 }
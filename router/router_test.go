@@ -2,34 +2,39 @@ package router
 
 import (
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRouterSubscribeUnsubscribe(t *testing.T) {
-	g := New(true)
+	g := newRouter(t, true)
 	c := make(chan []byte)
 	u, _, err := g.Subscribe(1, c)
 	if err != nil {
 		t.Errorf("First subscribe returned error %s", err.Error())
 	}
-	if len(g.allConnected) != 1 {
-		t.Error("Subscribe should add connection to allConnected")
+	if st := g.Stats(); st.Users != 1 || st.Connections != 1 {
+		t.Errorf("Subscribe should add 1 user and 1 connection, have %+v", st)
 	}
 	if _, _, err := g.Subscribe(2, c); err != ErrChannelAlreadySubscribed {
 		t.Error("Second subscribe didn't return ErrChannelAlreadySubscribed error")
 	}
-	if len(g.allConnected) != 1 {
-		t.Error("allConnected should not change")
+	if st := g.Stats(); st.Users != 1 || st.Connections != 1 {
+		t.Errorf("Second subscribe should not change Stats, have %+v", st)
 	}
 	u()
-	if len(g.allConnected) != 0 {
-		t.Error("allConnected should be empty")
+	if st := g.Stats(); st.Users != 0 || st.Connections != 0 {
+		t.Errorf("Unsubscribe should remove user and connection, have %+v", st)
 	}
 	u() // should be a NOOP at this point
 }
 
 func TestRouterActions(t *testing.T) {
-	g := New(true)
+	g := newRouter(t, true)
 
 	c1 := make(chan []byte, 1)
 	c2 := make(chan []byte, 1)
@@ -51,7 +56,7 @@ func TestRouterActions(t *testing.T) {
 		}
 	}
 
-	g.SendMsg(2, msg)
+	g.SendMsg(0, 2, msg)
 	if a, b, c := receivedMsg(c1), receivedMsg(c2), receivedMsg(c3); a || !b || c {
 		t.Errorf("Only client 2 should receive a message (%v, %v, %v)", a, b, c)
 	}
@@ -76,7 +81,7 @@ func TestRouterActions(t *testing.T) {
 	}
 
 	// NOOPS
-	g.SendMsg(4, msg)
+	g.SendMsg(0, 4, msg)
 	g.Unfollow(2, 3)
 
 	// first follow, then subscribe
@@ -88,3 +93,694 @@ func TestRouterActions(t *testing.T) {
 		t.Errorf("Only client 4 (follower of 1) should receive a message (%v, %v, %v, %v)", a, b, c, d)
 	}
 }
+
+func TestRouterDroppedAndFanout(t *testing.T) {
+	var fanout []int
+	g := newRouter(t, false, WithFanoutObserver(func(n int) {
+		fanout = append(fanout, n)
+	}))
+	c1 := make(chan []byte)
+	c2 := make(chan []byte, 1)
+	g.Subscribe(1, c1)
+	g.Subscribe(1, c2)
+	g.SendMsg(0, 1, []byte("msg"))
+	g.Broadcast([]byte("msg"))
+	if st := g.Stats(); st.Dropped != 3 {
+		t.Errorf("3 messages should be dropped, have %d", st.Dropped)
+	}
+	if want := []int{2, 2}; !reflect.DeepEqual(fanout, want) {
+		t.Errorf("Observed fanout %v, want %v", fanout, want)
+	}
+}
+
+func TestRouterOfflineStore(t *testing.T) {
+	g := newRouter(t, true, WithOfflineStore(OfflineLimits{MaxMessages: 3}))
+
+	// make user 2 known, so that it receives broadcasts
+	c := make(chan []byte, 1)
+	u, _, _ := g.Subscribe(2, c)
+	u()
+
+	g.Follow(2, 1)
+	g.SendMsg(0, 2, []byte("1"))
+	g.SendMsgToFollowers(1, []byte("2"))
+	g.Broadcast([]byte("3"))
+	g.SendMsg(0, 2, []byte("4")) // drops the oldest one
+	g.SendMsg(0, 3, []byte("5"))
+
+	// unbuffered channel, stored messages are delivered asynchronously
+	c2 := make(chan []byte)
+	u2, _, _ := g.Subscribe(2, c2)
+	defer u2()
+	go g.SendMsg(0, 2, []byte("6"))
+	for _, want := range []string{"2", "3", "4", "6"} {
+		select {
+		case m := <-c2:
+			if string(m) != want {
+				t.Errorf("Received %q, want %q", m, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message %q not received", want)
+		}
+	}
+
+	c3 := make(chan []byte, 1)
+	u3, _, _ := g.Subscribe(3, c3)
+	defer u3()
+	select {
+	case m := <-c3:
+		if string(m) != "5" {
+			t.Errorf("Received %q, want %q", m, "5")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stored message not received")
+	}
+}
+
+func TestRouterOfflineStoreUnsubscribe(t *testing.T) {
+	g := newRouter(t, true, WithOfflineStore(OfflineLimits{}))
+	g.SendMsg(0, 1, []byte("1"))
+	g.SendMsg(0, 1, []byte("2"))
+	c := make(chan []byte)
+	u, _, _ := g.Subscribe(1, c)
+	<-c
+	u()
+	close(c) // must not panic
+}
+
+func TestRouterFollows(t *testing.T) {
+	g := newRouter(t, false)
+	g.Follow(1, 2)
+	g.Follow(1, 3)
+	g.Follow(2, 1)
+	g.Unfollow(1, 3)
+	follows := g.Follows()
+	sort.Slice(follows, func(i, j int) bool {
+		return follows[i].FollowerID < follows[j].FollowerID
+	})
+	if want := []Follow{{1, 2}, {2, 1}}; !reflect.DeepEqual(follows, want) {
+		t.Errorf("Follows() = %v, want %v", follows, want)
+	}
+}
+
+func TestRouterBlock(t *testing.T) {
+	g := newRouter(t, true, WithOfflineStore(OfflineLimits{}))
+	c1 := make(chan []byte, 1)
+	c2 := make(chan []byte, 1)
+	g.Subscribe(1, c1)
+	g.Subscribe(2, c2)
+	g.Follow(1, 3)
+	g.Follow(2, 3)
+	g.Follow(4, 3) // offline
+	g.Block(1, 3)
+	g.Block(4, 3)
+	g.Block(2, 4)
+
+	g.SendMsgToFollowers(3, []byte("1"))
+	if a, b := received(c1), received(c2); a != "" || b != "1" {
+		t.Errorf("Only client 2 should receive status update, received (%q, %q)", a, b)
+	}
+	g.SendMsg(3, 1, []byte("2"))
+	g.SendMsg(2, 1, []byte("3"))
+	if a := received(c1); a != "3" {
+		t.Errorf("Client 1 received %q, want %q", a, "3")
+	}
+
+	if blocks, want := len(g.Blocks()), 3; blocks != want {
+		t.Errorf("Blocks() returned %d blocks, want %d", blocks, want)
+	}
+	g.Unblock(1, 3)
+	g.Unblock(2, 4)
+	if want := []Block{{4, 3}}; !reflect.DeepEqual(g.Blocks(), want) {
+		t.Errorf("Blocks() = %v, want %v", g.Blocks(), want)
+	}
+	g.SendMsgToFollowers(3, []byte("4"))
+	if a, b := received(c1), received(c2); a != "4" || b != "4" {
+		t.Errorf("Clients 1 and 2 should receive status update, received (%q, %q)", a, b)
+	}
+
+	// messages from blocked users are not stored for offline users
+	g.SendMsg(3, 4, []byte("5"))
+	g.SendMsg(2, 4, []byte("6"))
+	c4 := make(chan []byte, 1)
+	g.Subscribe(4, c4)
+	select {
+	case m := <-c4:
+		if string(m) != "6" {
+			t.Errorf("Client 4 received %q, want %q", m, "6")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stored message not received")
+	}
+}
+
+func TestRouterGroups(t *testing.T) {
+	g := newRouter(t, true, WithOfflineStore(OfflineLimits{}))
+	c1 := make(chan []byte, 1)
+	c2 := make(chan []byte, 1)
+	g.Subscribe(1, c1)
+	u2, _, _ := g.Subscribe(2, c2)
+	g.Join(1, 100)
+	g.Join(3, 100) // offline
+	g.Join(1, 200)
+	g.SendMsgToGroup(2, 100, []byte("1"))
+	if a, b := received(c1), received(c2); a != "1" || b != "" {
+		t.Errorf("Only client 1 should receive group message, received (%q, %q)", a, b)
+	}
+
+	g.Join(2, 100)
+	g.Block(1, 2)
+	g.SendMsgToGroup(2, 100, []byte("2"))
+	if a, b := received(c1), received(c2); a != "" || b != "2" {
+		t.Errorf("Only client 2 should receive group message, received (%q, %q)", a, b)
+	}
+
+	u2()
+	g.Leave(1, 100)
+	g.SendMsgToGroup(4, 100, []byte("3"))
+	if a, b := received(c1), received(c2); a != "" || b != "" {
+		t.Errorf("No client should receive group message, received (%q, %q)", a, b)
+	}
+
+	members := g.Memberships()
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].UserID < members[j].UserID ||
+			(members[i].UserID == members[j].UserID && members[i].GroupID < members[j].GroupID)
+	})
+	if want := []Membership{{1, 200}, {2, 100}, {3, 100}}; !reflect.DeepEqual(members, want) {
+		t.Errorf("Memberships() = %v, want %v", members, want)
+	}
+
+	// messages are stored for offline members
+	c3 := make(chan []byte, 3)
+	g.Subscribe(3, c3)
+	for _, want := range []string{"1", "2", "3"} {
+		select {
+		case m := <-c3:
+			if string(m) != want {
+				t.Errorf("Client 3 received %q, want %q", m, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Stored message %q not received", want)
+		}
+	}
+}
+
+func TestRouterSendMsgToUsers(t *testing.T) {
+	var fanout []int
+	g := newRouter(t, true, WithOfflineStore(OfflineLimits{}), WithFanoutObserver(func(n int) {
+		fanout = append(fanout, n)
+	}))
+	conns := []chan []byte{make(chan []byte, 2), make(chan []byte, 2), make(chan []byte, 2), make(chan []byte, 2)}
+	for i, userID := range []int{1, 1, 2, 4} {
+		g.Subscribe(userID, conns[i])
+	}
+	g.Block(4, 9)
+
+	g.SendMsgToUsers(9, []int{1, 2, 1, 3, 4}, []byte("m"))
+	if want := []int{3}; !reflect.DeepEqual(fanout, want) {
+		t.Errorf("Observed fanout %v, want %v", fanout, want)
+	}
+	for i, want := range []int{1, 1, 1, 0} {
+		if n := len(conns[i]); n != want {
+			t.Errorf("Client %d received %d messages, want %d", i, n, want)
+		}
+	}
+
+	// message is stored once for offline user
+	c3 := make(chan []byte, 2)
+	g.Subscribe(3, c3)
+	g.SendMsg(0, 3, []byte("x"))
+	for _, want := range []string{"m", "x"} {
+		select {
+		case m := <-c3:
+			if string(m) != want {
+				t.Errorf("Client 3 received %q, want %q", m, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message %q not received", want)
+		}
+	}
+}
+
+func TestRouterNewShards(t *testing.T) {
+	procs := 1
+	for procs < runtime.GOMAXPROCS(0) {
+		procs *= 2
+	}
+	for _, testCase := range []struct {
+		opts   []Option
+		shards int
+		err    error
+	}{
+		{nil, procs, nil},
+		{[]Option{WithShards(3)}, 4, nil},
+		{[]Option{WithGraph(NewDenseGraph), WithShards(1)}, 1, nil},
+		{[]Option{WithGraph(NewDenseGraph), WithShards(2)}, 0, ErrDenseGraphShards},
+	} {
+		g, err := New(true, testCase.opts...)
+		if err != testCase.err {
+			t.Errorf("New(%d options) returned %v, want %v", len(testCase.opts), err, testCase.err)
+			continue
+		}
+		if g != nil && len(g.shards) != testCase.shards {
+			t.Errorf("New(%d options) returned Router with %d shards, want %d", len(testCase.opts), len(g.shards), testCase.shards)
+		}
+	}
+}
+
+func TestRouterShards(t *testing.T) {
+	g := newRouter(t, true, WithShards(5))
+	if n := len(g.shards); n != 8 {
+		t.Fatalf("Router has %d shards, want 8", n)
+	}
+	// users x and y are in other shards than user a
+	a, x, y := 1, 0, 0
+	for id := 2; y == 0; id++ {
+		switch {
+		case g.shardIndex(id) == g.shardIndex(a):
+		case x == 0:
+			x = id
+		case y == 0:
+			y = id
+		}
+	}
+
+	// nobody reads c, so messages sent to a block
+	c := make(chan []byte)
+	g.Subscribe(a, c)
+	sent := make(chan struct{})
+	go func() {
+		g.SendMsg(0, a, []byte("1"))
+		close(sent)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		g.Follow(x, y)
+		g.SendMsgToFollowers(y, []byte("2"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Follow of users in other shards blocked by pending send")
+	}
+	<-c
+	<-sent
+}
+
+func TestRouterShardsOrder(t *testing.T) {
+	g := newRouter(t, true, WithShards(8))
+	const users = 32
+	c := make(chan []byte, 1000)
+	g.Subscribe(0, c)
+	for id := 1; id < users; id++ {
+		g.Follow(0, id)
+	}
+	g.Join(0, 100)
+
+	// concurrent subscriptions and follows of other users
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				id := users + i
+				u, _, _ := g.Subscribe(id, make(chan []byte, 1000))
+				g.Follow(id, j%users)
+				g.Join(id, 100)
+				u()
+				g.Unfollow(id, j%users)
+			}
+		}(i)
+	}
+
+	var want []string
+	for i := 0; i < 500; i++ {
+		msg, sender := strconv.Itoa(i), i%(users-1)+1
+		switch i % 4 {
+		case 0:
+			g.SendMsgToFollowers(sender, []byte(msg))
+		case 1:
+			g.SendMsg(sender, 0, []byte(msg))
+		case 2:
+			g.SendMsgToGroup(sender, 100, []byte(msg))
+		case 3:
+			g.SendMsgToUsers(sender, []int{sender, 0}, []byte(msg))
+		}
+		want = append(want, msg)
+	}
+	close(stop)
+	wg.Wait()
+
+	for _, w := range want {
+		if m := string(<-c); m != w {
+			t.Fatalf("Received %q, want %q", m, w)
+		}
+	}
+}
+
+func TestRouterAsyncFanout(t *testing.T) {
+	g := newRouter(t, true, WithAsyncFanout(2, 2))
+	// users a and x are sent to by different workers
+	a, x := 1, 2
+
+	// nobody reads ca, so worker of a gets stuck on the first message
+	ca, cx := make(chan []byte), make(chan []byte, 1)
+	unsubscribe, _, _ := g.Subscribe(a, ca)
+	g.Subscribe(x, cx)
+	sent := make(chan struct{})
+	go func() {
+		for _, msg := range []string{"1", "2", "3"} {
+			g.SendMsg(0, a, []byte(msg))
+		}
+		g.SendMsg(0, x, []byte("x"))
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("SendMsg blocked by slow client with free queue")
+	}
+	select {
+	case <-cx:
+	case <-time.After(time.Second):
+		t.Fatal("message to user of other worker not delivered")
+	}
+	if n := g.Stats().Queued; n != 2 {
+		t.Errorf("Stats().Queued = %d, want 2", n)
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		if msg := string(<-ca); msg != want {
+			t.Fatalf("got %q, want %q", msg, want)
+		}
+	}
+
+	// unsubscribe returns only once queued messages are sent
+	g.SendMsg(0, a, []byte("4"))
+	unsubscribed := make(chan struct{})
+	go func() {
+		unsubscribe()
+		close(unsubscribed)
+	}()
+	select {
+	case <-unsubscribed:
+		t.Fatal("unsubscribe returned before queued message was sent")
+	case msg := <-ca:
+		if string(msg) != "4" {
+			t.Fatalf("got %q, want %q", msg, "4")
+		}
+	}
+	<-unsubscribed
+	close(ca)
+	g.SendMsg(0, a, []byte("5"))
+}
+
+func TestRouterSendWorkers(t *testing.T) {
+	const delay = 10 * time.Millisecond
+	for _, workers := range []int{-1, 0, 1, 4} {
+		g := newRouter(t, true, WithSendWorkers(workers))
+		// channels start being read after delay, so that sends to them block
+		var wg sync.WaitGroup
+		for i := 0; i < 6; i++ {
+			c := make(chan []byte)
+			g.Subscribe(i, c)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				time.Sleep(delay)
+				if msg := string(<-c); msg != "1" {
+					t.Errorf("%d workers: received %q, want %q", workers, msg, "1")
+				}
+			}()
+		}
+		start := time.Now()
+		g.Broadcast([]byte("1"))
+		if d := time.Since(start); d < delay {
+			t.Errorf("%d workers: Broadcast returned after %s, before messages were received", workers, d)
+		}
+		wg.Wait()
+	}
+}
+
+func TestRouterClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	g := newRouter(t, true, WithSendWorkers(4), WithAsyncFanout(2, 4))
+	if n := runtime.NumGoroutine() - before; n < 6 {
+		t.Errorf("New started %d goroutines, want at least 6", n)
+	}
+	c := make(chan []byte, 2)
+	g.Subscribe(1, c)
+	g.Broadcast([]byte("1"))
+	g.Close()
+	if len(c) != 1 {
+		t.Error("Close returned before queued message was sent")
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Close left %d goroutines running", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// messages can be still sent, but only by calling goroutine
+	g.Broadcast([]byte("2"))
+	for _, want := range []string{"1", "2"} {
+		if msg := string(<-c); msg != want {
+			t.Errorf("got %q, want %q", msg, want)
+		}
+	}
+}
+
+func TestRouterSlowConsumerPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy       SlowConsumerPolicy
+		backlog      int
+		want         []string
+		disconnected bool
+		notice       string
+		stats        Stats
+	}{
+		{
+			policy:  SlowConsumerPolicy{Overflow: DropNewest},
+			backlog: 2,
+			want:    []string{"1", "2"},
+			stats:   Stats{Dropped: 2},
+		},
+		{
+			policy:  SlowConsumerPolicy{Overflow: DropOldest},
+			backlog: 2,
+			want:    []string{"3", "4"},
+			stats:   Stats{DroppedOldest: 2},
+		},
+		{
+			policy:  SlowConsumerPolicy{Overflow: Disconnect, MaxDrops: 3, Notice: []byte("bye")},
+			backlog: 2,
+			want:    []string{"1", "2"},
+			stats:   Stats{Dropped: 2},
+		},
+		{
+			policy:       SlowConsumerPolicy{Overflow: Disconnect, MaxDrops: 2, Notice: []byte("bye")},
+			backlog:      2,
+			want:         []string{},
+			disconnected: true,
+			notice:       "bye",
+			stats:        Stats{Dropped: 4, Disconnected: 1},
+		},
+		{
+			policy:       SlowConsumerPolicy{Overflow: Disconnect, MaxFullTime: time.Nanosecond},
+			backlog:      2,
+			want:         []string{},
+			disconnected: true,
+			stats:        Stats{Dropped: 4, Disconnected: 1},
+		},
+		{
+			// unbuffered channel has no room for notice
+			policy:       SlowConsumerPolicy{Overflow: Disconnect, MaxDrops: 1, Notice: []byte("bye")},
+			want:         []string{},
+			disconnected: true,
+			notice:       "bye",
+			stats:        Stats{Dropped: 4, Disconnected: 1},
+		},
+	} {
+		g := newRouter(t, false)
+		c := make(chan []byte, tc.backlog)
+		_, done, _ := g.SubscribeWithPolicy(1, c, tc.policy)
+		for _, msg := range []string{"1", "2", "3", "4"} {
+			time.Sleep(time.Millisecond)
+			g.SendMsg(0, 1, []byte(msg))
+		}
+		got := []string{}
+		for len(c) > 0 {
+			got = append(got, string(<-c))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.policy.Overflow, got, tc.want)
+		}
+		select {
+		case <-done:
+			if !tc.disconnected {
+				t.Errorf("%s: channel disconnected", tc.policy.Overflow)
+			}
+		default:
+			if tc.disconnected {
+				t.Errorf("%s: channel not disconnected", tc.policy.Overflow)
+			}
+		}
+		if notice := string(g.DisconnectNotice(c)); notice != tc.notice {
+			t.Errorf("%s: DisconnectNotice = %q, want %q", tc.policy.Overflow, notice, tc.notice)
+		}
+		stats := g.Stats()
+		stats.Users, stats.Connections = 0, 0
+		if stats != tc.stats {
+			t.Errorf("%s: Stats() = %+v, want %+v", tc.policy.Overflow, stats, tc.stats)
+		}
+	}
+}
+
+func TestRouterSetSlowConsumerPolicy(t *testing.T) {
+	g := newRouter(t, false, WithSlowConsumerPolicy(SlowConsumerPolicy{Overflow: DropOldest}))
+	c1, c2, c3 := make(chan []byte, 1), make(chan []byte, 1), make(chan []byte, 1)
+	g.Subscribe(1, c1)
+	g.SubscribeWithPolicy(2, c2, SlowConsumerPolicy{Overflow: DropNewest})
+	g.SubscribeWithPolicy(3, c3, SlowConsumerPolicy{Overflow: DropNewest})
+	if err := g.SetSlowConsumerPolicy(c3, SlowConsumerPolicy{Overflow: DropOldest}); err != nil {
+		t.Fatalf("SetSlowConsumerPolicy returned error %s", err.Error())
+	}
+	for _, msg := range []string{"1", "2"} {
+		g.Broadcast([]byte(msg))
+	}
+	for _, testCase := range []struct {
+		name string
+		c    <-chan []byte
+		want string
+	}{
+		{"send-only channel", c1, "1"}, // Router can't drop oldest message
+		{"channel subscribed with policy", c2, "1"},
+		{"channel with policy set", c3, "2"},
+	} {
+		if msg := string(<-testCase.c); msg != testCase.want {
+			t.Errorf("%s received %q, want %q", testCase.name, msg, testCase.want)
+		}
+	}
+	if err := g.SetSlowConsumerPolicy(make(chan []byte), SlowConsumerPolicy{}); err != ErrChannelNotSubscribed {
+		t.Errorf("SetSlowConsumerPolicy of not subscribed channel returned %v, want %v", err, ErrChannelNotSubscribed)
+	}
+}
+
+func TestRouterHistory(t *testing.T) {
+	for _, testCase := range []struct {
+		lastSeq int64
+		want    []string
+	}{
+		{0, []string{"2", "3", "5"}}, // "1" is not kept in history
+		{2, []string{"3", "5"}},
+		{5, nil},
+	} {
+		g := newRouter(t, true, WithHistory(2))
+		g.Follow(2, 1)
+		for i, send := range []func(msg []byte){
+			func(msg []byte) { g.SendMsg(0, 2, msg) },
+			func(msg []byte) { g.SendMsgToFollowers(1, msg) },
+			g.Broadcast,
+			func(msg []byte) { g.SendMsg(0, 3, msg) },
+			func(msg []byte) { g.SendMsg(0, 2, msg) },
+		} {
+			seq := int64(i + 1)
+			g.SetSeq(seq)
+			send([]byte(strconv.FormatInt(seq, 10)))
+		}
+
+		// unbuffered channel, messages from history are delivered asynchronously
+		c := make(chan []byte)
+		u, _, _ := g.SubscribeFrom(2, testCase.lastSeq, c)
+		go func() {
+			g.SetSeq(6)
+			g.SendMsg(0, 2, []byte("6"))
+		}()
+		for _, want := range append(testCase.want, "6") {
+			select {
+			case m := <-c:
+				if string(m) != want {
+					t.Errorf("SubscribeFrom(2, %d): received %q, want %q", testCase.lastSeq, m, want)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("SubscribeFrom(2, %d): message %q not received", testCase.lastSeq, want)
+			}
+		}
+		u()
+	}
+}
+
+func TestHistoryMaxUsers(t *testing.T) {
+	h := newHistory(2)
+	h.maxUsers = 4
+	for id := 1; id <= 4; id++ {
+		h.add(id, int64(id), []byte(strconv.Itoa(id)))
+	}
+	h.add(1, 5, []byte("5")) // user 1 was sent message most recently
+	h.add(5, 6, []byte("6"))
+	if len(h.users) != 4 {
+		t.Errorf("history has messages of %d users, want 4", len(h.users))
+	}
+	if msgs := h.since(2, 0); len(msgs) != 0 {
+		t.Errorf("since(2, 0) = %q, want messages of least recent user evicted", msgs)
+	}
+	if have, want := h.since(1, 0), [][]byte{[]byte("1"), []byte("5")}; !reflect.DeepEqual(have, want) {
+		t.Errorf("since(1, 0) = %q, want %q", have, want)
+	}
+}
+
+func TestOfflineStoreLimits(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newOfflineStore(OfflineLimits{MaxBytes: 4, MaxAge: time.Minute})
+	s.now = func() time.Time { return now }
+	s.push(1, []byte("a"))
+	now = now.Add(2 * time.Minute)
+	s.push(1, []byte("bb"))
+	s.push(1, []byte("ccccc")) // too big
+	s.push(1, []byte("dd"))
+	s.push(2, []byte("e"))
+	if have, want := s.take(1), [][]byte{[]byte("bb"), []byte("dd")}; !reflect.DeepEqual(have, want) {
+		t.Errorf("take(1) = %q, want %q", have, want)
+	}
+	now = now.Add(2 * time.Minute)
+	if have := s.take(2); len(have) != 0 {
+		t.Errorf("take(2) = %q, want expired messages removed", have)
+	}
+}
+
+func TestOfflineStoreSweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newOfflineStore(OfflineLimits{MaxAge: time.Minute, MaxUsers: 2})
+	s.now = func() time.Time { return now }
+	s.take(5)
+	s.leave(5)
+	s.push(1, []byte("a"))
+	s.push(2, []byte("b"))
+	s.push(3, []byte("c")) // too many users
+	if _, ok := s.queues[3]; ok || len(s.queues) != 2 {
+		t.Errorf("store has queues of %d users, want 2", len(s.queues))
+	}
+
+	now = now.Add(2 * time.Minute)
+	s.push(4, []byte("d"))
+	if _, ok := s.queues[4]; !ok || len(s.queues) != 1 {
+		t.Errorf("store has queues of %d users, want expired ones removed", len(s.queues))
+	}
+	if _, ok := s.known[5]; ok {
+		t.Error("user offline for longer than MaxAge should be forgotten")
+	}
+	s.broadcast([]byte("e"))
+	if _, ok := s.queues[5]; ok {
+		t.Error("broadcast should not be stored for forgotten user")
+	}
+}
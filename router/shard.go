@@ -0,0 +1,169 @@
+package router
+
+import (
+	"sort"
+	"sync"
+)
+
+// shard holds state of users (and groups) whose identifiers map to it.
+type shard struct {
+	mu sync.RWMutex
+
+	connectedClients   cSetsMap // of users
+	connectedFollowers cSetsMap // of followed users
+	connectedMembers   cSetsMap // of groups
+	allConnected       cSet     // of users
+
+	// inverted connection graph (follower -> followed)
+	invGraph Graph
+
+	// inverted block relation (blocked user -> blockers)
+	invBlocks Graph
+
+	// inverted group membership relation (member -> groups)
+	invGroups Graph
+
+	// set only with offline store or history enabled
+	graph  Graph // followers graph (followed -> followers)
+	groups Graph // members of groups (group -> members)
+}
+
+func newShard() *shard {
+	return &shard{
+		connectedClients:   make(cSetsMap),
+		connectedFollowers: make(cSetsMap),
+		connectedMembers:   make(cSetsMap),
+		allConnected:       make(cSet),
+	}
+}
+
+// resetGraphs replaces shard graphs with new, empty ones,
+// using newGraph for the inverted follow graph.
+func (sh *shard) resetGraphs(newGraph func() Graph, full bool) {
+	sh.invGraph = newGraph()
+	sh.invBlocks = NewSparseGraph()
+	sh.invGroups = NewSparseGraph()
+	if full {
+		sh.graph = NewSparseGraph()
+		sh.groups = NewSparseGraph()
+	}
+}
+
+// shardIndex returns index of shard that holds state of user (or group) id.
+func (g *Router) shardIndex(id int) int {
+	// Fibonacci hashing, so that consecutive identifiers spread evenly
+	return int(uint32(uint64(id)*0x9E3779B97F4A7C15>>32)) & g.shardMask
+}
+
+func (g *Router) shardOf(id int) *shard {
+	return g.shards[g.shardIndex(id)]
+}
+
+// lock2 exclusively locks shards of identifiers a and b (in shard order).
+func (g *Router) lock2(a, b int) (sa, sb *shard) {
+	i, j := g.shardIndex(a), g.shardIndex(b)
+	sa, sb = g.shards[i], g.shards[j]
+	switch {
+	case i < j:
+		sa.mu.Lock()
+		sb.mu.Lock()
+	case i > j:
+		sb.mu.Lock()
+		sa.mu.Lock()
+	default:
+		sa.mu.Lock()
+	}
+	return sa, sb
+}
+
+func unlock2(sa, sb *shard) {
+	sa.mu.Unlock()
+	if sb != sa {
+		sb.mu.Unlock()
+	}
+}
+
+// shardSet is a sorted set of shard indexes.
+type shardSet []int
+
+func (s shardSet) add(i int) shardSet {
+	j := sort.SearchInts(s, i)
+	if j < len(s) && s[j] == i {
+		return s
+	}
+	s = append(s, 0)
+	copy(s[j+1:], s[j:])
+	s[j] = i
+	return s
+}
+
+func (s shardSet) contains(other shardSet) bool {
+	for _, i := range other {
+		if j := sort.SearchInts(s, i); j == len(s) || s[j] != i {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *Router) lockShards(s shardSet) {
+	for _, i := range s {
+		g.shards[i].mu.Lock()
+	}
+}
+
+func (g *Router) unlockShards(s shardSet) {
+	for _, i := range s {
+		g.shards[i].mu.Unlock()
+	}
+}
+
+func (g *Router) rlockShards(s shardSet) {
+	for _, i := range s {
+		g.shards[i].mu.RLock()
+	}
+}
+
+func (g *Router) runlockShards(s shardSet) {
+	for _, i := range s {
+		g.shards[i].mu.RUnlock()
+	}
+}
+
+// userShards returns shards of userID and of users and groups it's
+// connected to in ig (follows) and igr (group memberships). It must be
+// called with shard of userID locked.
+func (g *Router) userShards(userID int, ig, igr Graph) shardSet {
+	s := shardSet{g.shardIndex(userID)}
+	f := func(id int) bool {
+		s = s.add(g.shardIndex(id))
+		return true
+	}
+	ig.Neighbors(userID, f)
+	igr.Neighbors(userID, f)
+	return s
+}
+
+// lockUser exclusively locks (in shard order) shards returned by userShards
+// for graphs returned by graphs, which is called with shard of userID locked.
+// It returns set of locked shards.
+func (g *Router) lockUser(userID int, graphs func(sh *shard) (ig, igr Graph)) shardSet {
+	sh := g.shardOf(userID)
+	sh.mu.RLock()
+	ig, igr := graphs(sh)
+	s := g.userShards(userID, ig, igr)
+	sh.mu.RUnlock()
+	for {
+		g.lockShards(s)
+		// follows and memberships of userID may have changed in the meantime
+		ig, igr = graphs(sh)
+		cur := g.userShards(userID, ig, igr)
+		if s.contains(cur) {
+			return s
+		}
+		g.unlockShards(s)
+		for _, i := range cur {
+			s = s.add(i)
+		}
+	}
+}
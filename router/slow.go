@@ -0,0 +1,167 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy defines how Router handles messages
+// sent to channels that are full. It implements flag.Value interface.
+type OverflowPolicy int
+
+// Overflow policies.
+const (
+	// DropNewest drops the message being sent.
+	DropNewest OverflowPolicy = iota
+	// DropOldest drops the oldest message queued in channel to make room.
+	DropOldest
+	// Disconnect drops the message being sent and disconnects channel
+	// once limits of SlowConsumerPolicy are exceeded.
+	Disconnect
+)
+
+var overflowPolicyNames = [...]string{
+	DropNewest: "drop-newest",
+	DropOldest: "drop-oldest",
+	Disconnect: "disconnect",
+}
+
+func (p OverflowPolicy) String() string {
+	if p < 0 || int(p) >= len(overflowPolicyNames) {
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+	return overflowPolicyNames[p]
+}
+
+// Set sets policy from its name.
+func (p *OverflowPolicy) Set(name string) error {
+	for i, n := range overflowPolicyNames {
+		if n == name {
+			*p = OverflowPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown overflow policy %q (use %s)", name, strings.Join(overflowPolicyNames[:], ", "))
+}
+
+// SlowConsumerPolicy defines how non-blocking sends handle channels that are full.
+type SlowConsumerPolicy struct {
+	Overflow OverflowPolicy
+
+	// MaxDrops is the number of messages dropped since channel got full
+	// that makes Disconnect policy disconnect it (0 means no limit).
+	MaxDrops int64
+
+	// MaxFullTime is the time since channel got full that makes
+	// Disconnect policy disconnect it (0 means no limit).
+	// With neither limit set channel is disconnected on the first drop.
+	MaxFullTime time.Duration
+
+	// Notice is the message to be sent to clients of channels disconnected
+	// by Disconnect policy (see Router.DisconnectNotice).
+	Notice []byte
+}
+
+// conn is a subscribed channel.
+type conn struct {
+	// accessed atomically
+	drops     int64 // since channel got full
+	fullSince int64 // in Unix nanoseconds, 0 if not full
+	kicked    int32
+
+	userID int
+	recv   <-chan []byte // nil if Router can't receive from channel
+	policy atomic.Value  // *SlowConsumerPolicy
+
+	// closed on reset or disconnect
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(userID int, recv <-chan []byte, p *SlowConsumerPolicy) *conn {
+	cn := &conn{
+		userID: userID,
+		recv:   recv,
+		done:   make(chan struct{}),
+	}
+	cn.policy.Store(p)
+	return cn
+}
+
+func (cn *conn) close() {
+	cn.closeOnce.Do(func() {
+		close(cn.done)
+	})
+}
+
+// trySend sends msg to c without blocking, handling full c according to its policy.
+func (g *Router) trySend(c chan<- []byte, cn *conn, msg []byte) {
+	if atomic.LoadInt32(&cn.kicked) != 0 {
+		atomic.AddInt64(&g.dropped, 1)
+		return
+	}
+	select {
+	case c <- msg:
+		if atomic.LoadInt64(&cn.fullSince) != 0 {
+			atomic.StoreInt64(&cn.fullSince, 0)
+			atomic.StoreInt64(&cn.drops, 0)
+		}
+		return
+	default:
+	}
+
+	p := cn.policy.Load().(*SlowConsumerPolicy)
+	switch p.Overflow {
+	case DropOldest:
+		for {
+			select {
+			case <-cn.recv:
+				atomic.AddInt64(&g.droppedOldest, 1)
+			default:
+				// nothing queued to drop (c is unbuffered
+				// or Router can't receive from it)
+				atomic.AddInt64(&g.dropped, 1)
+				return
+			}
+			select {
+			case c <- msg:
+				return
+			default:
+			}
+		}
+	case Disconnect:
+		atomic.AddInt64(&g.dropped, 1)
+		now := time.Now().UnixNano()
+		atomic.CompareAndSwapInt64(&cn.fullSince, 0, now)
+		drops := atomic.AddInt64(&cn.drops, 1)
+		full := time.Duration(now - atomic.LoadInt64(&cn.fullSince))
+		if p.MaxDrops == 0 && p.MaxFullTime == 0 ||
+			p.MaxDrops > 0 && drops >= p.MaxDrops ||
+			p.MaxFullTime > 0 && full >= p.MaxFullTime {
+			g.kick(cn)
+		}
+	default: // DropNewest
+		atomic.AddInt64(&g.dropped, 1)
+	}
+}
+
+// kick drops messages queued in c and closes its done channel,
+// so that it gets unsubscribed.
+func (g *Router) kick(cn *conn) {
+	if !atomic.CompareAndSwapInt32(&cn.kicked, 0, 1) {
+		return
+	}
+	atomic.AddInt64(&g.disconnected, 1)
+	defer cn.close()
+	for drained := false; !drained; {
+		select {
+		case <-cn.recv:
+			atomic.AddInt64(&g.dropped, 1)
+		default:
+			drained = true
+		}
+	}
+}
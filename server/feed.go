@@ -0,0 +1,221 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/telendt/fmaze/event"
+)
+
+var errBadSourceHandshake = errors.New("bad event source handshake")
+
+// parseSourceHandshake parses "name" or "name|startSeq" handshake line.
+func parseSourceHandshake(line []byte, defaultStartSeq int64) (name string, startSeq int64, err error) {
+	fields := strings.SplitN(strings.TrimSpace(string(line)), "|", 2)
+	name, startSeq = fields[0], defaultStartSeq
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return "", 0, errBadSourceHandshake
+	}
+	if len(fields) == 2 {
+		if startSeq, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return "", 0, errBadSourceHandshake
+		}
+	}
+	return name, startSeq, nil
+}
+
+// feed is an independently numbered stream of events of named event sources.
+// Relations made by its events are removed when it's reset, unless other
+// feeds made them too. Relations removed by its events are removed no matter
+// which feeds made them, just like with a single event source.
+type feed struct {
+	name       string
+	dispatcher *event.Dispatcher
+	conns      int                   // guarded by Server.sourcesMu
+	relations  map[relation]struct{} // guarded by Server.relationsMu
+}
+
+// relationKind is a kind of relation between users (or user and group).
+type relationKind int
+
+const (
+	followRelation relationKind = iota
+	blockRelation
+	memberRelation
+)
+
+// relation is a follow, block or group membership made by feed's events.
+type relation struct {
+	kind       relationKind
+	head, tail int
+}
+
+// joinFeed returns feed of given name, creating it if needed.
+// It must be called with s.sourcesMu locked.
+func (s *Server) joinFeed(name string, startSeq int64) *feed {
+	f, ok := s.feeds[name]
+	if !ok {
+		f = &feed{
+			name:      name,
+			relations: make(map[relation]struct{}),
+		}
+		f.dispatcher = event.NewDispatcher(feedActions{s, f}, startSeq, s.opts.EventsCapacity,
+			event.WithInitialCapacity(s.opts.EventsInitialCapacity),
+			event.WithGapPolicy(event.GapPolicy{
+				Timeout:     s.opts.GapTimeout,
+				MaxBuffered: s.opts.GapMaxBuffered,
+				OnSkip:      s.onSkip,
+			}))
+		s.mu.Lock()
+		s.feeds[name] = f
+		s.mu.Unlock()
+	}
+	f.conns++
+	return f
+}
+
+// leaveFeed removes event source from feed f. Once the last one is gone,
+// f is removed along with relations it made, unless reset is false.
+// It must be called with s.sourcesMu locked.
+func (s *Server) leaveFeed(f *feed, reset bool) {
+	f.conns--
+	if f.conns > 0 || !reset {
+		return
+	}
+	s.mu.Lock()
+	delete(s.feeds, f.name)
+	s.mu.Unlock()
+	f.dispatcher.Reset() // stops gap timer
+
+	s.relationsMu.Lock()
+	defer s.relationsMu.Unlock()
+	for r := range f.relations {
+		s.unref(r)
+	}
+	f.relations = nil
+	atomic.AddInt64(&s.stats.Resets, 1)
+}
+
+// ref acquires relation r, it must be called with s.relationsMu locked.
+func (s *Server) ref(r relation) {
+	if s.relationRefs[r]++; s.relationRefs[r] > 1 {
+		return
+	}
+	switch r.kind {
+	case followRelation:
+		s.router.Follow(r.head, r.tail)
+	case blockRelation:
+		s.router.Block(r.head, r.tail)
+	case memberRelation:
+		s.router.Join(r.head, r.tail)
+	}
+}
+
+// unref releases relation r, it must be called with s.relationsMu locked.
+func (s *Server) unref(r relation) {
+	if _, ok := s.relationRefs[r]; !ok {
+		return // already removed by another feed
+	}
+	if s.relationRefs[r]--; s.relationRefs[r] > 0 {
+		return
+	}
+	delete(s.relationRefs, r)
+	switch r.kind {
+	case followRelation:
+		s.router.Unfollow(r.head, r.tail)
+	case blockRelation:
+		s.router.Unblock(r.head, r.tail)
+	case memberRelation:
+		s.router.Leave(r.head, r.tail)
+	}
+}
+
+// feedNames returns sorted names of feeds, it must be called with s.mu locked.
+func (s *Server) feedNames() []string {
+	names := make([]string, 0, len(s.feeds))
+	for name := range s.feeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// feedActions applies actions of feed's events to router, keeping track
+// of relations made by them, so that these can be removed on feed reset.
+// Relations are removed for all the feeds that made them.
+type feedActions struct {
+	s *Server
+	f *feed
+}
+
+func (a feedActions) add(r relation) {
+	a.s.relationsMu.Lock()
+	defer a.s.relationsMu.Unlock()
+	if _, ok := a.f.relations[r]; ok {
+		return
+	}
+	a.f.relations[r] = struct{}{}
+	a.s.ref(r)
+}
+
+func (a feedActions) remove(r relation) {
+	a.s.relationsMu.Lock()
+	defer a.s.relationsMu.Unlock()
+	if _, ok := a.s.relationRefs[r]; !ok {
+		return
+	}
+	a.s.mu.Lock()
+	for _, f := range a.s.feeds {
+		delete(f.relations, r)
+	}
+	a.s.mu.Unlock()
+	a.s.relationRefs[r] = 1
+	a.s.unref(r)
+}
+
+func (a feedActions) Follow(followerID, followedID int) {
+	a.add(relation{followRelation, followerID, followedID})
+}
+
+func (a feedActions) Unfollow(followerID, followedID int) {
+	a.remove(relation{followRelation, followerID, followedID})
+}
+
+func (a feedActions) Block(blockerID, blockedID int) {
+	a.add(relation{blockRelation, blockerID, blockedID})
+}
+
+func (a feedActions) Unblock(blockerID, blockedID int) {
+	a.remove(relation{blockRelation, blockerID, blockedID})
+}
+
+func (a feedActions) Join(userID, groupID int) {
+	a.add(relation{memberRelation, userID, groupID})
+}
+
+func (a feedActions) Leave(userID, groupID int) {
+	a.remove(relation{memberRelation, userID, groupID})
+}
+
+func (a feedActions) SendMsg(senderID, userID int, msg []byte) {
+	a.s.router.SendMsg(senderID, userID, msg)
+}
+
+func (a feedActions) SendMsgToUsers(senderID int, userIDs []int, msg []byte) {
+	a.s.router.SendMsgToUsers(senderID, userIDs, msg)
+}
+
+func (a feedActions) SendMsgToFollowers(userID int, msg []byte) {
+	a.s.router.SendMsgToFollowers(userID, msg)
+}
+
+func (a feedActions) SendMsgToGroup(senderID, groupID int, msg []byte) {
+	a.s.router.SendMsgToGroup(senderID, groupID, msg)
+}
+
+func (a feedActions) Broadcast(msg []byte) {
+	a.s.router.Broadcast(msg)
+}
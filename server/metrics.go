@@ -0,0 +1,121 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/telendt/fmaze/event"
+	"github.com/telendt/fmaze/metrics"
+)
+
+func (s *Server) registerMetrics() {
+	r := &metrics.Registry{}
+	counter := func(name, help string, v *int64) {
+		r.RegisterFunc(name, help, metrics.CounterType, func() float64 {
+			return float64(atomic.LoadInt64(v))
+		})
+	}
+	byType := func(name, help string, counts *[256]int64) {
+		r.Register(name, help, metrics.CounterType, func() []metrics.Sample {
+			var samples []metrics.Sample
+			for t := range counts {
+				if n := atomic.LoadInt64(&counts[t]); n > 0 {
+					samples = append(samples, metrics.Sample{
+						Labels: []metrics.Label{{Name: "type", Value: string(rune(t))}},
+						Value:  float64(n),
+					})
+				}
+			}
+			return samples
+		})
+	}
+
+	r.RegisterFunc("fmaze_clients", "Number of connected user clients.", metrics.GaugeType, func() float64 {
+		return float64(atomic.LoadInt64(&s.stats.Clients))
+	})
+	r.RegisterFunc("fmaze_users", "Number of distinct connected users.", metrics.GaugeType, func() float64 {
+		return float64(s.router.Stats().Users)
+	})
+	byType("fmaze_events_parsed_total", "Number of parsed events by type.", &s.parsed)
+	byType("fmaze_events_dispatched_total", "Number of dispatched events by type.", &s.dispatched)
+	r.Register("fmaze_events_rejected_total", "Number of rejected event lines by error class.", metrics.CounterType, func() []metrics.Sample {
+		samples := make([]metrics.Sample, 0, len(ErrorClasses))
+		for _, class := range ErrorClasses {
+			samples = append(samples, metrics.Sample{
+				Labels: []metrics.Label{{Name: "class", Value: class.String()}},
+				Value:  float64(atomic.LoadInt64(&s.rejected[class])),
+			})
+		}
+		return samples
+	})
+	counter("fmaze_events_skipped_total", "Number of missing events skipped by gap policy.", &s.stats.Skipped)
+	// with named sources every dispatcher is labeled with source name
+	byDispatcher := func(name, help string, value func(*event.Dispatcher) int64) {
+		r.Register(name, help, metrics.GaugeType, func() []metrics.Sample {
+			if !s.opts.NamedSources {
+				return []metrics.Sample{{Value: float64(value(s.dispatcher))}}
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			samples := make([]metrics.Sample, 0, len(s.feeds))
+			for _, name := range s.feedNames() {
+				samples = append(samples, metrics.Sample{
+					Labels: []metrics.Label{{Name: "source", Value: name}},
+					Value:  float64(value(s.feeds[name].dispatcher)),
+				})
+			}
+			return samples
+		})
+	}
+	byDispatcher("fmaze_dispatcher_seq", "Sequence number of the next expected event.", (*event.Dispatcher).Seq)
+	byDispatcher("fmaze_dispatcher_buffered", "Number of unordered events waiting for missing ones.", func(d *event.Dispatcher) int64 {
+		return int64(d.Buffered())
+	})
+	r.RegisterHistogram("fmaze_router_fanout", "Number of recipients of routed messages.", s.fanout)
+	r.RegisterFunc("fmaze_router_dropped_messages_total", "Number of messages dropped by non-blocking sends.", metrics.CounterType, func() float64 {
+		return float64(s.router.Stats().Dropped)
+	})
+	r.RegisterFunc("fmaze_router_fanout_queued", "Number of messages waiting in fan-out worker queues.", metrics.GaugeType, func() float64 {
+		return float64(s.router.Stats().Queued)
+	})
+	r.RegisterFunc("fmaze_router_dropped_oldest_messages_total", "Number of queued messages dropped to make room by drop-oldest policy.", metrics.CounterType, func() float64 {
+		return float64(s.router.Stats().DroppedOldest)
+	})
+	r.RegisterFunc("fmaze_router_disconnected_clients_total", "Number of slow clients disconnected by disconnect policy.", metrics.CounterType, func() float64 {
+		return float64(s.router.Stats().Disconnected)
+	})
+	counter("fmaze_messages_delivered_total", "Number of messages written to user clients.", &s.stats.Delivered)
+	counter("fmaze_messages_dropped_total", "Number of messages that couldn't be written to user clients.", &s.stats.Dropped)
+	r.RegisterFunc("fmaze_forwarder_flushes_total", "Number of client writer flushes.", metrics.CounterType, func() float64 {
+		return float64(s.forwarder.Counters().Flushes)
+	})
+	r.RegisterFunc("fmaze_forwarder_written_bytes_total", "Number of bytes written to user clients.", metrics.CounterType, func() float64 {
+		return float64(s.forwarder.Counters().Bytes)
+	})
+	counter("fmaze_event_source_connections_total", "Number of accepted event source connections.", &s.stats.SourceConnections)
+	counter("fmaze_resets_total", "Number of internal state resets.", &s.stats.Resets)
+	r.RegisterFunc("fmaze_event_sources", "Number of connected event sources.", metrics.GaugeType, func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(len(s.activeSources))
+	})
+	bySource := func(name, help string, value func(SourceStats) int64) {
+		r.Register(name, help, metrics.CounterType, func() []metrics.Sample {
+			stats := s.sourceStats()
+			samples := make([]metrics.Sample, len(stats))
+			for i, st := range stats {
+				samples[i] = metrics.Sample{
+					Labels: []metrics.Label{{Name: "source", Value: st.Addr}},
+					Value:  float64(value(st)),
+				}
+			}
+			return samples
+		})
+	}
+	bySource("fmaze_source_events_total", "Number of events accepted from connected event sources.", func(st SourceStats) int64 {
+		return st.Events
+	})
+	bySource("fmaze_source_rejected_total", "Number of event lines rejected from connected event sources.", func(st SourceStats) int64 {
+		return st.Rejected
+	})
+	s.metrics = r
+}
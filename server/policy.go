@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/telendt/fmaze/event"
+)
+
+// ErrorClass classifies errors of rejected event lines.
+type ErrorClass int
+
+// Error classes of rejected event lines.
+const (
+	BadFormat          ErrorClass = iota // event.ErrBadFormat
+	UnknownType                          // *event.UnknownTypeError
+	BadArgumentsNumber                   // *event.BadArgumentsNumberError
+	SeqTooSmall                          // event.ErrSeqTooSmall
+	SeqTooLarge                          // event.ErrSeqTooLarge
+	SeqDuplicate                         // event.ErrSeqDuplicate
+	WALAppend                            // failed write-ahead log append
+	numErrorClasses
+)
+
+// ErrorClasses lists all error classes.
+var ErrorClasses = []ErrorClass{BadFormat, UnknownType, BadArgumentsNumber, SeqTooSmall, SeqTooLarge, SeqDuplicate, WALAppend}
+
+var errorClassNames = [...]string{
+	BadFormat:          "bad-format",
+	UnknownType:        "unknown-type",
+	BadArgumentsNumber: "bad-args",
+	SeqTooSmall:        "seq-too-small",
+	SeqTooLarge:        "seq-too-large",
+	SeqDuplicate:       "seq-duplicate",
+	WALAppend:          "wal-append",
+}
+
+// valid reports whether c is one of ErrorClasses.
+func (c ErrorClass) valid() bool {
+	return c >= 0 && c < numErrorClasses
+}
+
+func (c ErrorClass) String() string {
+	if !c.valid() {
+		return fmt.Sprintf("ErrorClass(%d)", int(c))
+	}
+	return errorClassNames[c]
+}
+
+// classify returns class of error returned by event.Parse, Dispatcher.Dispatch
+// or loggedTrigger.
+func classify(err error) ErrorClass {
+	switch err.(type) {
+	case *walAppendError:
+		return WALAppend
+	case *event.UnknownTypeError:
+		return UnknownType
+	case *event.BadArgumentsNumberError:
+		return BadArgumentsNumber
+	}
+	switch err {
+	case event.ErrSeqTooSmall:
+		return SeqTooSmall
+	case event.ErrSeqTooLarge:
+		return SeqTooLarge
+	case event.ErrSeqDuplicate:
+		return SeqDuplicate
+	}
+	return BadFormat
+}
+
+// ErrorPolicy defines how server handles rejected event lines.
+// It implements flag.Value interface.
+type ErrorPolicy int
+
+// Error policies.
+const (
+	// Disconnect logs rejected line and closes event source connection.
+	Disconnect ErrorPolicy = iota
+	// SkipAndLog logs and skips rejected line.
+	SkipAndLog
+	// SkipSilently skips rejected line.
+	SkipSilently
+	// DeadLetter skips rejected line, leaving it only to server's DeadLetterer
+	// (it's logged if there's none).
+	DeadLetter
+)
+
+var errorPolicyNames = [...]string{
+	Disconnect:   "disconnect",
+	SkipAndLog:   "skip-and-log",
+	SkipSilently: "skip-silently",
+	DeadLetter:   "dead-letter",
+}
+
+func (p ErrorPolicy) String() string {
+	if p < 0 || int(p) >= len(errorPolicyNames) {
+		return fmt.Sprintf("ErrorPolicy(%d)", int(p))
+	}
+	return errorPolicyNames[p]
+}
+
+// Set sets policy from its name.
+func (p *ErrorPolicy) Set(name string) error {
+	for i, n := range errorPolicyNames {
+		if n == name {
+			*p = ErrorPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown error policy %q (use %s)", name, strings.Join(errorPolicyNames[:], ", "))
+}
+
+// DeadLetterer is the interface that wraps the DeadLetter method.
+//
+// DeadLetter records event line rejected with err, read from source.
+// It's called for every rejected line, regardless of error policy.
+type DeadLetterer interface {
+	DeadLetter(source string, line []byte, err error)
+}
@@ -0,0 +1,792 @@
+// Package server wires event source and user clients listeners together
+// so that fmaze can be embedded in other programs.
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	stdio "io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/telendt/fmaze/event"
+	"github.com/telendt/fmaze/io"
+	"github.com/telendt/fmaze/metrics"
+	"github.com/telendt/fmaze/router"
+	"github.com/telendt/fmaze/wal"
+)
+
+var (
+	// ErrServerStarted is returned by Listen and Run methods of Server
+	// when server has already been started.
+	ErrServerStarted = errors.New("server: already started")
+
+	// ErrNamedSources is returned by Listen and Run methods of Server
+	// when named sources are used with unsupported options.
+	ErrNamedSources = errors.New("server: named sources can't be used with WAL, snapshots or history")
+
+	// ErrUnknownErrorClass is returned by SetErrorPolicy, Listen and Run
+	// methods of Server when error class isn't one of ErrorClasses.
+	ErrUnknownErrorClass = errors.New("server: unknown error class")
+
+	nilTime time.Time
+)
+
+// SlowConsumerNotice is the line sent to clients disconnected for not keeping
+// up with their messages (see Options.SlowConsumer).
+const SlowConsumerNotice = "!disconnected: slow consumer\n"
+
+// Options configure Server.
+type Options struct {
+	// AdminListenAddr is admin HTTP listen address serving /metrics
+	// and /snapshot (POST) endpoints (no admin listener if empty).
+	AdminListenAddr string
+
+	// AuthTimeout is a client authentication timeout.
+	AuthTimeout time.Duration
+
+	// ClientsListenAddr is user clients listen address.
+	ClientsListenAddr string
+
+	// EventSourceListenAddr is event source listen address.
+	EventSourceListenAddr string
+
+	// DrainTimeout is the maximum time given to user clients to receive
+	// pending messages on shutdown.
+	DrainTimeout time.Duration
+
+	// ErrorPolicies define how rejected event lines are handled
+	// (Disconnect for classes not in the map).
+	ErrorPolicies map[ErrorClass]ErrorPolicy
+
+	// DeadLetter records all rejected event lines.
+	DeadLetter DeadLetterer
+
+	// EventsCapacity is a maximum capacity of unordered events store.
+	EventsCapacity int
+
+	// EventsInitialCapacity is an initial capacity of unordered events store.
+	EventsInitialCapacity int
+
+	// FlushInterval is a write flush interval.
+	FlushInterval time.Duration
+
+	// GapTimeout is the maximum time to wait for a missing event
+	// before skipping it (0 means wait forever).
+	GapTimeout time.Duration
+
+	// GapMaxBuffered is the maximum number of events waiting for a missing
+	// event before it's skipped (0 means no limit).
+	GapMaxBuffered int
+
+	// FanoutWorkers is the number of goroutines sending messages to user
+	// clients (see router.WithAsyncFanout), so that events are dispatched
+	// without waiting for clients to accept their messages (0 disables).
+	FanoutWorkers int
+
+	// FanoutQueueSize is the maximum number of messages queued for every
+	// fan-out worker, events aren't dispatched while a queue is full.
+	FanoutQueueSize int
+
+	// Graph creates follow graph used by router (router.NewSparseGraph if nil).
+	Graph func() router.Graph
+
+	// HistorySize is the number of latest messages kept for every user
+	// (and of latest broadcasts), so that clients authenticating with
+	// "userID|lastSeq" get messages sent after lastSeq (0 disables history).
+	HistorySize int
+
+	// HistoryMaxUsers is the maximum number of users whose messages are kept
+	// in history (see router.WithHistoryMaxUsers, 0 means no limit).
+	HistoryMaxUsers int
+
+	// MsgBacklog is a client message backlog.
+	MsgBacklog int
+
+	// NoBackpressure disables client write backpressure.
+	NoBackpressure bool
+
+	// NamedSources makes event sources identify themselves with a "name"
+	// or "name|startSeq" handshake line. Events of every name are numbered
+	// independently, starting from startSeq (StartSequence by default),
+	// and ordered by a separate dispatcher, but applied to the same router.
+	// Follow graph is the union of graphs built by every name and only
+	// the part built by a name is reset when its last event source goes away.
+	// It can't be used with WAL, SnapshotFile or HistorySize.
+	NamedSources bool
+
+	// NoReset disables internal state reset on event source disconnect.
+	NoReset bool
+
+	// OfflineStore enables storing messages for disconnected users
+	// and delivering them once they connect.
+	OfflineStore bool
+
+	// OfflineLimits bound messages stored for a single disconnected user
+	// and the number of users with stored messages.
+	OfflineLimits router.OfflineLimits
+
+	// ReadBufferSize is a read buffer size in bytes.
+	ReadBufferSize int
+
+	// RouterShards is the number of router shards (rounded up to a power
+	// of 2, GOMAXPROCS if 0), each with its own lock and graphs (see
+	// router.WithShards). It must be 1 with router.NewDenseGraph.
+	RouterShards int
+
+	// SendWorkers is the number of goroutines sending messages to clients
+	// that aren't ready to receive them with backpressure, shared by all
+	// the messages (see router.WithSendWorkers, GOMAXPROCS if 0 and none
+	// if negative, so that a goroutine is started for every such message).
+	SendWorkers int
+
+	// SlowConsumer defines how clients that don't keep up with their messages
+	// are handled with NoBackpressure (see router.SlowConsumerPolicy).
+	// Clients disconnected by router.Disconnect policy are sent
+	// a SlowConsumerNotice line after messages already written to them.
+	SlowConsumer router.SlowConsumerPolicy
+
+	// SnapshotFile is a file that follow graph snapshots are written to
+	// (on Snapshot calls, every SnapshotInterval and on shutdown)
+	// and restored from on Listen (no snapshots if empty).
+	// It's removed when internal state is reset.
+	SnapshotFile string
+
+	// SnapshotInterval is the period of taking snapshots (0 disables periodic snapshots).
+	SnapshotInterval time.Duration
+
+	// SourceBackpressure makes server stop reading from event source
+	// while unordered events store is full, instead of disconnecting it.
+	// Missing events need to be skipped by gap policy for reading to resume.
+	SourceBackpressure bool
+
+	// StartSequence is a sequence start number.
+	StartSequence int64
+
+	// UseWritev makes client writers try to use writev instead of write syscall.
+	UseWritev bool
+
+	// WAL, if not nil, logs events in the order they're dispatched.
+	// Follow graph is restored from it on Listen and the event sequence
+	// continues after the last logged event. It's reset along with
+	// the internal state when event source disconnects. Events that fail
+	// to be logged aren't applied, but rejected with WALAppend error class.
+	WAL *wal.Log
+
+	// WriteBufferSize is a write buffer size in bytes.
+	WriteBufferSize int
+}
+
+// DefaultOptions holds default server options.
+var DefaultOptions = Options{
+	AuthTimeout:           1 * time.Second,
+	ClientsListenAddr:     ":9099",
+	DrainTimeout:          5 * time.Second,
+	EventSourceListenAddr: ":9090",
+	EventsCapacity:        100000,
+	EventsInitialCapacity: event.DefaultInitialCapacity,
+	FanoutQueueSize:       1024,
+	FlushInterval:         10 * time.Second,
+	HistoryMaxUsers:       100000,
+	MsgBacklog:            10,
+	OfflineLimits: router.OfflineLimits{
+		MaxMessages: 100,
+		MaxBytes:    64 << 10,
+		MaxAge:      time.Hour,
+		MaxUsers:    100000,
+	},
+	ReadBufferSize:  4096,
+	StartSequence:   1,
+	WriteBufferSize: 4096,
+}
+
+// Stats holds server statistics.
+type Stats struct {
+	// Events is the number of events accepted from event source.
+	Events int64
+	// Skipped is the number of missing events skipped by gap policy.
+	Skipped int64
+	// Clients is the number of currently subscribed user clients.
+	Clients int64
+	// Delivered is the number of messages written to user clients.
+	Delivered int64
+	// Dropped is the number of messages that couldn't be written to user clients.
+	Dropped int64
+	// SourceConnections is the number of accepted event source connections.
+	SourceConnections int64
+	// Resets is the number of internal state resets.
+	Resets int64
+	// Rejected is the number of rejected event lines by error class.
+	Rejected map[ErrorClass]int64
+	// Sources holds statistics of connected event sources.
+	Sources []SourceStats
+}
+
+// connGroup is a set of active connections.
+type connGroup struct {
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func newConnGroup() *connGroup {
+	return &connGroup{conns: make(map[net.Conn]struct{})}
+}
+
+// Server reads events from event sources and forwards them to user clients.
+// Events of all the connected event sources are merged into one ordered stream.
+type Server struct {
+	// accessed atomically
+	parsed     [256]int64 // by event type
+	dispatched [256]int64 // by event type
+	rejected   [numErrorClasses]int64
+	stats      Stats
+	policies   [numErrorClasses]int32
+
+	opts       Options
+	router     *router.Router
+	routerErr  error // returned by Listen
+	dispatcher *event.Dispatcher
+	forwarder  io.MaxLatencyForwarder
+	metrics    *metrics.Registry
+	fanout     *metrics.Histogram
+
+	// policy of client channels with Options.NoBackpressure
+	slowConsumer router.SlowConsumerPolicy
+
+	mu       sync.Mutex
+	started  bool
+	restored bool
+
+	// held while taking snapshot or resetting internal state
+	snapshotMu sync.Mutex
+
+	// held while event source is being added or removed
+	sourcesMu     sync.Mutex
+	activeSources map[*source]struct{} // guarded by mu
+	feeds         map[string]*feed     // guarded by sourcesMu and mu
+
+	// relations made by named sources feeds
+	relationsMu  sync.Mutex
+	relationRefs map[relation]int
+
+	cl      net.Listener
+	sl      net.Listener
+	al      net.Listener
+	clients *connGroup
+	sources *connGroup
+
+	// closed on shutdown
+	quit chan struct{}
+
+	// closed when user clients should drain their pending messages
+	draining      chan struct{}
+	drainDeadline time.Time
+}
+
+// New returns a new Server configured with opts.
+func New(opts Options) *Server {
+	s := &Server{
+		opts:      opts,
+		forwarder: io.NewMaxLatencyForwarder(opts.WriteBufferSize, opts.FlushInterval, opts.UseWritev),
+		fanout:    metrics.NewHistogram(0, 1, 2, 5, 10, 100, 1000, 10000),
+		clients:   newConnGroup(),
+		sources:   newConnGroup(),
+		quit:      make(chan struct{}),
+		draining:  make(chan struct{}),
+
+		activeSources: make(map[*source]struct{}),
+		feeds:         make(map[string]*feed),
+		relationRefs:  make(map[relation]int),
+	}
+	for class, p := range opts.ErrorPolicies {
+		// unknown classes are reported by Listen
+		s.SetErrorPolicy(class, p)
+	}
+	rtOpts := []router.Option{
+		router.WithFanoutObserver(func(n int) {
+			s.fanout.Observe(float64(n))
+		}),
+	}
+	if opts.Graph != nil {
+		rtOpts = append(rtOpts, router.WithGraph(opts.Graph))
+	}
+	rtOpts = append(rtOpts, router.WithShards(opts.RouterShards),
+		router.WithSendWorkers(opts.SendWorkers))
+	if opts.NoBackpressure {
+		s.slowConsumer = opts.SlowConsumer
+		s.slowConsumer.Notice = []byte(SlowConsumerNotice)
+		rtOpts = append(rtOpts, router.WithSlowConsumerPolicy(s.slowConsumer))
+	}
+	if opts.FanoutWorkers > 0 {
+		rtOpts = append(rtOpts, router.WithAsyncFanout(opts.FanoutWorkers, opts.FanoutQueueSize))
+	}
+	if opts.OfflineStore {
+		rtOpts = append(rtOpts, router.WithOfflineStore(opts.OfflineLimits))
+	}
+	if opts.HistorySize > 0 {
+		rtOpts = append(rtOpts, router.WithHistory(opts.HistorySize),
+			router.WithHistoryMaxUsers(opts.HistoryMaxUsers))
+	}
+	var err error
+	if s.router, err = router.New(!opts.NoBackpressure, rtOpts...); err != nil {
+		// reported by Listen, router with one shard keeps Server usable until then
+		s.routerErr = err
+		s.router, _ = router.New(!opts.NoBackpressure, append(rtOpts, router.WithShards(1))...)
+	}
+	s.dispatcher = event.NewDispatcher(s.router, opts.StartSequence, opts.EventsCapacity,
+		event.WithInitialCapacity(opts.EventsInitialCapacity),
+		event.WithGapPolicy(event.GapPolicy{
+			Timeout:     opts.GapTimeout,
+			MaxBuffered: opts.GapMaxBuffered,
+			OnSkip:      s.onSkip,
+		}))
+	s.registerMetrics()
+	return s
+}
+
+func (s *Server) onSkip(from, to int64) {
+	log.Printf("skipped missing events %d-%d\n", from, to)
+	atomic.AddInt64(&s.stats.Skipped, to-from+1)
+}
+
+// Listen restores follow graph from write-ahead log (if configured) and binds
+// user clients, event source and admin (if configured) listeners.
+// It is called by Run, but it's useful to call it directly when listeners
+// addresses need to be known before Run is called.
+func (s *Server) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cl != nil {
+		return nil
+	}
+	if s.opts.NamedSources && (s.opts.WAL != nil || s.opts.SnapshotFile != "" || s.opts.HistorySize > 0) {
+		return ErrNamedSources
+	}
+	if s.routerErr != nil {
+		return s.routerErr
+	}
+	for class := range s.opts.ErrorPolicies {
+		if !class.valid() {
+			return ErrUnknownErrorClass
+		}
+	}
+	if !s.restored {
+		if err := s.restore(); err != nil {
+			return err
+		}
+		s.restored = true
+	}
+	cl, err := net.Listen("tcp", s.opts.ClientsListenAddr)
+	if err != nil {
+		return err
+	}
+	sl, err := net.Listen("tcp", s.opts.EventSourceListenAddr)
+	if err != nil {
+		cl.Close()
+		return err
+	}
+	if s.opts.AdminListenAddr != "" {
+		al, err := net.Listen("tcp", s.opts.AdminListenAddr)
+		if err != nil {
+			cl.Close()
+			sl.Close()
+			return err
+		}
+		s.al = al
+	}
+	s.cl, s.sl = cl, sl
+	return nil
+}
+
+// ClientsAddr returns user clients listener network address
+// or nil if server is not listening.
+func (s *Server) ClientsAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cl == nil {
+		return nil
+	}
+	return s.cl.Addr()
+}
+
+// EventSourceAddr returns event source listener network address
+// or nil if server is not listening.
+func (s *Server) EventSourceAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sl == nil {
+		return nil
+	}
+	return s.sl.Addr()
+}
+
+// AdminAddr returns admin listener network address
+// or nil if server is not listening or admin listener is not configured.
+func (s *Server) AdminAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.al == nil {
+		return nil
+	}
+	return s.al.Addr()
+}
+
+// SetErrorPolicy sets policy p for event lines rejected with errors of given class.
+// It returns ErrUnknownErrorClass if class isn't one of ErrorClasses.
+func (s *Server) SetErrorPolicy(class ErrorClass, p ErrorPolicy) error {
+	if !class.valid() {
+		return ErrUnknownErrorClass
+	}
+	atomic.StoreInt32(&s.policies[class], int32(p))
+	return nil
+}
+
+// ErrorPolicy returns policy for event lines rejected with errors of given class,
+// Disconnect if class isn't one of ErrorClasses.
+func (s *Server) ErrorPolicy(class ErrorClass) ErrorPolicy {
+	if !class.valid() {
+		return Disconnect
+	}
+	return ErrorPolicy(atomic.LoadInt32(&s.policies[class]))
+}
+
+// Stats returns server statistics.
+func (s *Server) Stats() Stats {
+	rejected := make(map[ErrorClass]int64, numErrorClasses)
+	for _, class := range ErrorClasses {
+		rejected[class] = atomic.LoadInt64(&s.rejected[class])
+	}
+	return Stats{
+		Events:            atomic.LoadInt64(&s.stats.Events),
+		Skipped:           atomic.LoadInt64(&s.stats.Skipped),
+		Clients:           atomic.LoadInt64(&s.stats.Clients),
+		Delivered:         atomic.LoadInt64(&s.stats.Delivered),
+		Dropped:           atomic.LoadInt64(&s.stats.Dropped),
+		SourceConnections: atomic.LoadInt64(&s.stats.SourceConnections),
+		Resets:            atomic.LoadInt64(&s.stats.Resets),
+		Rejected:          rejected,
+		Sources:           s.sourceStats(),
+	}
+}
+
+// Run accepts user clients and event source connections until ctx is done
+// or any of the listeners fails. Then it stops accepting new connections,
+// stops reading events and gives user clients up to DrainTimeout to receive
+// their pending messages before all the connections are closed.
+// Server can only be run once.
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.started {
+		s.mu.Unlock()
+		return ErrServerStarted
+	}
+	s.started = true
+	s.mu.Unlock()
+
+	errc := make(chan error, 3)
+	go func() { errc <- s.serveClients() }()
+	go func() { errc <- s.serveEventSource() }()
+	var admin *http.Server
+	if s.al != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.metrics)
+		mux.HandleFunc("/snapshot", s.serveSnapshot)
+		admin = &http.Server{Handler: mux}
+		go func() {
+			if err := admin.Serve(s.al); !s.closing() {
+				errc <- err
+			}
+		}()
+	}
+
+	if s.opts.SnapshotFile != "" && s.opts.SnapshotInterval > 0 {
+		go s.snapshotLoop()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errc:
+	}
+	if admin != nil {
+		defer admin.Close()
+	}
+	s.shutdown()
+	s.router.Close()
+	if s.opts.SnapshotFile != "" {
+		if serr := s.Snapshot(); serr != nil {
+			log.Printf("snapshot: %s\n", serr.Error())
+		}
+	}
+	return err
+}
+
+// MetricsHandler returns HTTP handler serving server metrics
+// in the Prometheus text format.
+func (s *Server) MetricsHandler() http.Handler {
+	return s.metrics
+}
+
+func (s *Server) shutdown() {
+	deadline := time.Now().Add(s.opts.DrainTimeout)
+
+	s.mu.Lock()
+	close(s.quit)
+	s.cl.Close()
+	s.sl.Close()
+	for conn := range s.sources.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	// let the event source finish dispatching its last event
+	waitUntil(&s.sources.wg, deadline)
+
+	s.drainDeadline = deadline
+	close(s.draining)
+	if !waitUntil(&s.clients.wg, deadline) {
+		s.mu.Lock()
+		for conn := range s.clients.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+	}
+	s.sources.wg.Wait()
+	s.clients.wg.Wait()
+}
+
+// waitUntil waits for wg until deadline and reports whether it's done.
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	c := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
+	t := time.NewTimer(deadline.Sub(time.Now()))
+	defer t.Stop()
+	select {
+	case <-c:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// track adds conn to the group of active connections. It returns false
+// (and closes conn) if server is shutting down.
+func (s *Server) track(g *connGroup, conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.quit:
+		conn.Close()
+		return false
+	default:
+	}
+	g.conns[conn] = struct{}{}
+	g.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrack(g *connGroup, conn net.Conn) {
+	s.mu.Lock()
+	delete(g.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+	g.wg.Done()
+}
+
+// closing reports whether server is shutting down.
+func (s *Server) closing() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) serveClients() error {
+	for {
+		conn, err := s.cl.Accept()
+		if err != nil {
+			if s.closing() {
+				return nil
+			}
+			return err
+		}
+		if !s.track(s.clients, conn) {
+			continue
+		}
+		go func() {
+			defer s.untrack(s.clients, conn)
+			s.handleClient(conn)
+		}()
+	}
+}
+
+// readHandshake reads client handshake line, which is either "userID"
+// or "userID|lastSeq" for clients resuming after lastSeq event.
+func readHandshake(r stdio.Reader) (userID int, lastSeq int64, resume bool, err error) {
+	line, err := bufio.NewReaderSize(r, 64).ReadSlice('\n')
+	if err != nil && (err != stdio.EOF || len(line) == 0) {
+		return
+	}
+	fields := strings.SplitN(strings.TrimSpace(string(line)), "|", 2)
+	if userID, err = strconv.Atoi(fields[0]); err != nil || len(fields) == 1 {
+		return
+	}
+	lastSeq, err = strconv.ParseInt(fields[1], 10, 64)
+	return userID, lastSeq, err == nil, err
+}
+
+func (s *Server) handleClient(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(s.opts.AuthTimeout))
+	userID, lastSeq, resume, err := readHandshake(conn)
+	if err != nil {
+		return
+	}
+	c := make(chan []byte, s.opts.MsgBacklog)
+	var (
+		unsubscribe router.UnsubscribeFunc
+		done        <-chan struct{}
+	)
+	if resume {
+		unsubscribe, done, _ = s.router.SubscribeFrom(userID, lastSeq, c)
+	} else {
+		unsubscribe, done, _ = s.router.SubscribeWithPolicy(userID, c, s.slowConsumer)
+	}
+	defer unsubscribe()
+	atomic.AddInt64(&s.stats.Clients, 1)
+	defer atomic.AddInt64(&s.stats.Clients, -1)
+
+	// stop unsubscribes c and closes it, so that Forward writes
+	// all the pending messages and returns
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			unsubscribe()
+			close(c)
+		})
+	}
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		conn.SetReadDeadline(nilTime)
+		_, _ = stdio.Copy(ioutil.Discard, conn)
+		stop()
+	}()
+	go func() {
+		select {
+		case <-s.draining:
+			conn.SetWriteDeadline(s.drainDeadline)
+			stop()
+		case <-done:
+			// Forward writes messages that are already queued
+			conn.SetWriteDeadline(time.Now().Add(s.opts.DrainTimeout))
+		case <-finished:
+		}
+	}()
+	stats := s.forwarder.Forward(done, conn, c)
+	if notice := s.router.DisconnectNotice(c); notice != nil {
+		conn.SetWriteDeadline(time.Now().Add(s.opts.DrainTimeout))
+		conn.Write(notice)
+	}
+	atomic.AddInt64(&s.stats.Delivered, int64(stats.Written))
+	atomic.AddInt64(&s.stats.Dropped, int64(stats.Dropped))
+	// Forward may return before c gets closed, keep draining it
+	// so that blocking senders don't get stuck on it.
+	go func() {
+		var n int64
+		for range c {
+			n++
+		}
+		atomic.AddInt64(&s.stats.Dropped, n)
+	}()
+}
+
+func (s *Server) serveEventSource() error {
+	for {
+		conn, err := s.sl.Accept()
+		if err != nil {
+			if s.closing() {
+				return nil
+			}
+			return err
+		}
+		if !s.track(s.sources, conn) {
+			continue
+		}
+		atomic.AddInt64(&s.stats.SourceConnections, 1)
+		go func() {
+			defer s.untrack(s.sources, conn)
+			s.serveSource(conn)
+		}()
+	}
+}
+
+func (s *Server) handleEventSource(r *bufio.Reader, src *source) {
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		e, err := event.Parse(line)
+		if err == nil {
+			atomic.AddInt64(&s.parsed[e.Type], 1)
+			if s.opts.WAL != nil {
+				e.ActionsTrigger = loggedTrigger{s, src, e.Seq, line, e.ActionsTrigger}
+			}
+			if s.opts.SourceBackpressure {
+				err = src.dispatcher.DispatchWait(s.quit, e)
+			} else {
+				err = src.dispatcher.Dispatch(e)
+			}
+		}
+		if err != nil {
+			atomic.AddInt64(&src.rejected, 1)
+			if s.closing() || !s.reject(src, line, err) {
+				return
+			}
+			continue
+		}
+		atomic.AddInt64(&s.dispatched[e.Type], 1)
+		atomic.AddInt64(&s.stats.Events, 1)
+		atomic.AddInt64(&src.events, 1)
+	}
+}
+
+// reject handles event line rejected with err according to error policy.
+// It reports whether reading from conn should continue.
+func (s *Server) reject(src *source, line []byte, err error) bool {
+	class := classify(err)
+	atomic.AddInt64(&s.rejected[class], 1)
+	if s.opts.DeadLetter != nil {
+		s.opts.DeadLetter.DeadLetter(src.addr, line, err)
+	}
+	switch s.ErrorPolicy(class) {
+	case Disconnect:
+		log.Printf("%s: %q\n", err.Error(), line)
+		return false
+	case SkipSilently:
+	case DeadLetter:
+		if s.opts.DeadLetter != nil {
+			break
+		}
+		fallthrough
+	default:
+		log.Printf("%s: %q\n", err.Error(), line)
+	}
+	return true
+}
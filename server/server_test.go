@@ -0,0 +1,807 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/telendt/fmaze/router"
+	"github.com/telendt/fmaze/snapshot"
+	"github.com/telendt/fmaze/wal"
+)
+
+type testServer struct {
+	*Server
+	cancel context.CancelFunc
+	errc   chan error
+}
+
+func startServer(t *testing.T, opts Options) *testServer {
+	opts.ClientsListenAddr = "127.0.0.1:0"
+	opts.EventSourceListenAddr = "127.0.0.1:0"
+	s := New(opts)
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(ctx) }()
+	return &testServer{s, cancel, errc}
+}
+
+func (s *testServer) stop(t *testing.T) {
+	s.cancel()
+	select {
+	case err := <-s.errc:
+		if err != nil {
+			t.Errorf("Run returned error %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after context cancel")
+	}
+}
+
+type testClient struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialClient(t *testing.T, s *Server, userID int) *testClient {
+	return dialClientHandshake(t, s, strconv.Itoa(userID))
+}
+
+func dialClientHandshake(t *testing.T, s *Server, handshake string) *testClient {
+	conn, err := net.Dial("tcp", s.ClientsAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "%s\n", handshake)
+	return &testClient{conn, bufio.NewReader(conn)}
+}
+
+func (c *testClient) readLine(t *testing.T) string {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Client read failed: %s", err.Error())
+	}
+	return line
+}
+
+// waitSubscribed broadcasts events starting from seq until all clients
+// receive one and returns the next sequence number.
+func waitSubscribed(t *testing.T, src net.Conn, seq int64, clients ...*testClient) int64 {
+	ready := make([]bool, len(clients))
+	deadline := time.Now().Add(5 * time.Second)
+	for n := 0; n < len(clients); {
+		if time.Now().After(deadline) {
+			t.Fatal("Clients didn't subscribe in time")
+		}
+		fmt.Fprintf(src, "%d|B\n", seq)
+		seq++
+		for i, c := range clients {
+			if ready[i] {
+				continue
+			}
+			c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+			if _, err := c.r.ReadString('\n'); err == nil {
+				ready[i] = true
+				n++
+			}
+		}
+	}
+	// skip broadcasts that are still on their way
+	for _, c := range clients {
+		for {
+			c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+			if _, err := c.r.ReadString('\n'); err != nil {
+				break
+			}
+		}
+	}
+	return seq
+}
+
+func testOptions() Options {
+	opts := DefaultOptions
+	opts.FlushInterval = 0
+	opts.WriteBufferSize = 0
+	return opts
+}
+
+func TestServerRun(t *testing.T) {
+	s := startServer(t, testOptions())
+	defer s.stop(t)
+
+	src, err := net.Dial("tcp", s.EventSourceAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	c1 := dialClient(t, s.Server, 1)
+	defer c1.Close()
+	c2 := dialClient(t, s.Server, 2)
+	defer c2.Close()
+
+	seq := waitSubscribed(t, src, 1, c1, c2)
+
+	// send events out of order
+	events := []string{
+		fmt.Sprintf("%d|P|2|1\n", seq+1),
+		fmt.Sprintf("%d|F|2|1\n", seq),
+		fmt.Sprintf("%d|S|1\n", seq+2),
+	}
+	for _, e := range events {
+		fmt.Fprint(src, e)
+	}
+	for _, want := range []string{events[1], events[0]} {
+		if got := c1.readLine(t); got != want {
+			t.Errorf("Client 1 received %q, want %q", got, want)
+		}
+	}
+	if got := c2.readLine(t); got != events[2] {
+		t.Errorf("Client 2 received %q, want %q", got, events[2])
+	}
+
+	// group messages reach all the members
+	groupMsg := fmt.Sprintf("%d|G|3|100\n", seq+5)
+	fmt.Fprintf(src, "%d|J|1|100\n%d|J|2|100\n%s", seq+3, seq+4, groupMsg)
+	for i, c := range []*testClient{c1, c2} {
+		if got := c.readLine(t); got != groupMsg {
+			t.Errorf("Client %d received %q, want %q", i+1, got, groupMsg)
+		}
+	}
+
+	// mentioned users receive message once
+	mention := fmt.Sprintf("%d|M|3|2,1,2\n", seq+6)
+	fmt.Fprint(src, mention)
+	fmt.Fprintf(src, "%d|P|3|2\n", seq+7)
+	if got := c1.readLine(t); got != mention {
+		t.Errorf("Client 1 received %q, want %q", got, mention)
+	}
+	for _, want := range []string{mention, fmt.Sprintf("%d|P|3|2\n", seq+7)} {
+		if got := c2.readLine(t); got != want {
+			t.Errorf("Client 2 received %q, want %q", got, want)
+		}
+	}
+}
+
+func TestServerMultipleSources(t *testing.T) {
+	s := startServer(t, testOptions())
+	defer s.stop(t)
+
+	var srcs [2]net.Conn
+	for i := range srcs {
+		src, err := net.Dial("tcp", s.EventSourceAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+		srcs[i] = src
+	}
+	c := dialClient(t, s.Server, 1)
+	defer c.Close()
+	seq := waitSubscribed(t, srcs[0], 1, c)
+	waitStats(t, s.Server, func(st Stats) bool { return len(st.Sources) == 2 })
+
+	// each source sends every other event
+	for i := int64(3); i >= 0; i-- {
+		fmt.Fprintf(srcs[i%2], "%d|P|2|1\n", seq+i)
+	}
+	for i := int64(0); i < 4; i++ {
+		if got, want := c.readLine(t), fmt.Sprintf("%d|P|2|1\n", seq+i); got != want {
+			t.Errorf("Client received %q, want %q", got, want)
+		}
+	}
+	for _, st := range s.Stats().Sources {
+		want := seq + 1 // broadcasts and 2 events
+		if st.Addr == srcs[1].LocalAddr().String() {
+			want = 2
+		}
+		if st.Events != want {
+			t.Errorf("Source %s accepted %d events, want %d", st.Addr, st.Events, want)
+		}
+	}
+
+	srcs[0].Close()
+	waitStats(t, s.Server, func(st Stats) bool { return len(st.Sources) == 1 })
+	fmt.Fprintf(srcs[1], "%d|P|2|1\n", seq+4)
+	if got, want := c.readLine(t), fmt.Sprintf("%d|P|2|1\n", seq+4); got != want {
+		t.Errorf("Client received %q, want %q", got, want)
+	}
+	if n := s.Stats().Resets; n != 0 {
+		t.Errorf("State reset %d times while a source is connected", n)
+	}
+
+	srcs[1].Close()
+	waitStats(t, s.Server, func(st Stats) bool { return st.Resets == 1 && len(st.Sources) == 0 })
+}
+
+func TestServerNamedSources(t *testing.T) {
+	opts := testOptions()
+	opts.NamedSources = true
+	s := startServer(t, opts)
+	defer s.stop(t)
+
+	dialSource := func(handshake string) net.Conn {
+		src, err := net.Dial("tcp", s.EventSourceAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(src, "%s\n", handshake)
+		return src
+	}
+	expect := func(c *testClient, want string) {
+		if got := c.readLine(t); got != want {
+			t.Errorf("Client received %q, want %q", got, want)
+		}
+	}
+
+	graph := dialSource("graph")
+	defer graph.Close()
+	notif := dialSource("notif|100")
+	c1 := dialClient(t, s.Server, 1)
+	defer c1.Close()
+	c2 := dialClient(t, s.Server, 2)
+	defer c2.Close()
+	seq := waitSubscribed(t, graph, 1, c1, c2)
+
+	fmt.Fprintf(graph, "%d|F|1|2\n", seq)
+	expect(c2, fmt.Sprintf("%d|F|1|2\n", seq))
+	fmt.Fprint(notif, "100|S|2\n")
+	expect(c1, "100|S|2\n")
+
+	// reconnecting feed starts over, but follows of the other feed are kept
+	notif.Close()
+	waitStats(t, s.Server, func(st Stats) bool { return st.Resets == 1 })
+	notif = dialSource("notif")
+	defer notif.Close()
+	fmt.Fprint(notif, "1|S|2\n2|F|1|2\n")
+	expect(c1, "1|S|2\n")
+	expect(c2, "2|F|1|2\n")
+
+	// follow made by both feeds is kept when one of them resets,
+	// but it's removed by the other one
+	graph.Close()
+	waitStats(t, s.Server, func(st Stats) bool { return st.Resets == 2 })
+	fmt.Fprint(notif, "3|S|2\n4|U|1|2\n5|S|2\n6|P|2|1\n")
+	expect(c1, "3|S|2\n")
+	expect(c1, "6|P|2|1\n")
+
+	// follow made by one feed is removed by the other one
+	fmt.Fprint(notif, "7|F|1|2\n")
+	expect(c2, "7|F|1|2\n")
+	graph = dialSource("graph|1")
+	defer graph.Close()
+	fmt.Fprint(graph, "1|U|1|2\n2|P|2|1\n")
+	expect(c1, "2|P|2|1\n")
+	fmt.Fprint(notif, "8|S|2\n9|P|2|1\n")
+	expect(c1, "9|P|2|1\n")
+
+	if err := New(Options{NamedSources: true, HistorySize: 1}).Listen(); err != ErrNamedSources {
+		t.Errorf("Listen returned %v, want %v", err, ErrNamedSources)
+	}
+}
+
+func TestParseSourceHandshake(t *testing.T) {
+	for _, testCase := range []struct {
+		line     string
+		name     string
+		startSeq int64
+		err      bool
+	}{
+		{"graph\n", "graph", 1, false},
+		{"graph|100\r\n", "graph", 100, false},
+		{"graph|x\n", "", 0, true},
+		{"my graph\n", "", 0, true},
+		{"\n", "", 0, true},
+	} {
+		name, startSeq, err := parseSourceHandshake([]byte(testCase.line), 1)
+		if name != testCase.name || startSeq != testCase.startSeq || (err != nil) != testCase.err {
+			t.Errorf("parseSourceHandshake(%q) = %q, %d, %v", testCase.line, name, startSeq, err)
+		}
+	}
+}
+
+func TestServerRunShutdown(t *testing.T) {
+	s := startServer(t, testOptions())
+	c := dialClient(t, s.Server, 1)
+	defer c.Close()
+	s.stop(t)
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.r.ReadString('\n'); err == nil {
+		t.Error("Client connection should be closed after shutdown")
+	}
+	if _, err := net.Dial("tcp", s.ClientsAddr().String()); err == nil {
+		t.Error("Clients listener should be closed after shutdown")
+	}
+}
+
+func TestServerSlowConsumerNotice(t *testing.T) {
+	opts := testOptions()
+	opts.MsgBacklog = 0
+	opts.NoBackpressure = true
+	opts.SlowConsumer = router.SlowConsumerPolicy{Overflow: router.Disconnect}
+	s := startServer(t, opts)
+	defer s.stop(t)
+
+	c := dialClient(t, s.Server, 1)
+	defer c.Close()
+	waitStats(t, s.Server, func(st Stats) bool { return st.Clients == 1 })
+	src, err := net.Dial("tcp", s.EventSourceAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	// client doesn't read until it's disconnected
+	w := bufio.NewWriter(src)
+	deadline := time.Now().Add(5 * time.Second)
+	for seq := 1; s.router.Stats().Disconnected == 0; seq++ {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for slow client to be disconnected")
+		}
+		fmt.Fprintf(w, "%d|P|2|1\n", seq)
+		if seq%1000 == 0 {
+			w.Flush()
+		}
+	}
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var last string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		last = line
+	}
+	if last != SlowConsumerNotice {
+		t.Errorf("Last line received by disconnected client is %q, want %q", last, SlowConsumerNotice)
+	}
+}
+
+func waitStats(t *testing.T, s *Server, cond func(Stats) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond(s.Stats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for stats, have %+v", s.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServerRunDrain(t *testing.T) {
+	opts := testOptions()
+	opts.FlushInterval = time.Hour
+	opts.WriteBufferSize = 4096
+	s := startServer(t, opts)
+
+	c := dialClient(t, s.Server, 1)
+	defer c.Close()
+	waitStats(t, s.Server, func(st Stats) bool { return st.Clients == 1 })
+
+	src, err := net.Dial("tcp", s.EventSourceAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	events := []string{"1|P|2|1\n", "2|B\n"}
+	for _, e := range events {
+		fmt.Fprint(src, e)
+	}
+	waitStats(t, s.Server, func(st Stats) bool { return st.Events == 2 })
+
+	s.stop(t)
+	for _, want := range events {
+		if got := c.readLine(t); got != want {
+			t.Errorf("Client received %q, want %q", got, want)
+		}
+	}
+	if st := s.Stats(); st.Delivered != 2 || st.Dropped != 0 {
+		t.Errorf("Want 2 messages delivered and 0 dropped, have %+v", st)
+	}
+}
+
+func TestServerSourceBackpressure(t *testing.T) {
+	for _, testCase := range []struct {
+		events  []string
+		skipped int64
+	}{
+		// 1 is missing and 3 doesn't fit until it's skipped
+		{[]string{"2|P|2|1\n", "3|P|3|1\n", "4|P|4|1\n"}, 1},
+		// 5 doesn't fit while nothing is buffered
+		{[]string{"5|P|5|1\n", "6|P|6|1\n"}, 4},
+	} {
+		opts := testOptions()
+		opts.EventsCapacity = 2
+		opts.GapTimeout = 20 * time.Millisecond
+		opts.SourceBackpressure = true
+		s := startServer(t, opts)
+
+		c := dialClient(t, s.Server, 1)
+		waitStats(t, s.Server, func(st Stats) bool { return st.Clients == 1 })
+
+		src, err := net.Dial("tcp", s.EventSourceAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range testCase.events {
+			fmt.Fprint(src, e)
+		}
+		for _, want := range testCase.events {
+			if got := c.readLine(t); got != want {
+				t.Errorf("Client received %q, want %q", got, want)
+			}
+		}
+		if st := s.Stats(); st.Skipped != testCase.skipped {
+			t.Errorf("Want %d skipped events, have %d", testCase.skipped, st.Skipped)
+		}
+		src.Close()
+		c.Close()
+		s.stop(t)
+	}
+}
+
+func TestServerResume(t *testing.T) {
+	opts := testOptions()
+	opts.HistorySize = 10
+	s := startServer(t, opts)
+	defer s.stop(t)
+
+	src, err := net.Dial("tcp", s.EventSourceAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	c := dialClient(t, s.Server, 1)
+	seq := waitSubscribed(t, src, 1, c)
+	fmt.Fprintf(src, "%d|P|2|1\n", seq)
+	if got, want := c.readLine(t), fmt.Sprintf("%d|P|2|1\n", seq); got != want {
+		t.Errorf("Client received %q, want %q", got, want)
+	}
+	c.Close()
+	waitStats(t, s.Server, func(st Stats) bool { return st.Clients == 0 })
+
+	// sent while client is disconnected
+	fmt.Fprintf(src, "%d|P|3|1\n%d|P|3|2\n%d|B\n", seq+1, seq+2, seq+3)
+	waitStats(t, s.Server, func(st Stats) bool { return st.Events == seq+3 })
+
+	c = dialClientHandshake(t, s.Server, fmt.Sprintf("1|%d", seq))
+	defer c.Close()
+	fmt.Fprintf(src, "%d|P|4|1\n", seq+4)
+	for _, want := range []string{
+		fmt.Sprintf("%d|P|3|1\n", seq+1),
+		fmt.Sprintf("%d|B\n", seq+3),
+		fmt.Sprintf("%d|P|4|1\n", seq+4),
+	} {
+		if got := c.readLine(t); got != want {
+			t.Errorf("Resumed client received %q, want %q", got, want)
+		}
+	}
+}
+
+func TestServerWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := wal.Open(dir, wal.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions()
+	opts.NoReset = true
+	opts.WAL = l
+	s := startServer(t, opts)
+	src, err := net.Dial("tcp", s.EventSourceAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(src, "1|F|1|2\n2|F|1|3\n3|U|1|3\n")
+	waitStats(t, s.Server, func(st Stats) bool { return st.Events == 3 })
+	src.Close()
+	s.stop(t)
+	l.Close()
+
+	// restart with the same log
+	if l, err = wal.Open(dir, wal.DefaultOptions); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	opts.WAL = l
+	s = startServer(t, opts)
+	defer s.stop(t)
+	if seq := s.dispatcher.Seq(); seq != 4 {
+		t.Errorf("Dispatcher expects sequence %d after restore, want 4", seq)
+	}
+	if src, err = net.Dial("tcp", s.EventSourceAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	c := dialClient(t, s.Server, 1)
+	defer c.Close()
+	seq := waitSubscribed(t, src, 4, c)
+
+	// user 1 still follows user 2, but not user 3
+	fmt.Fprintf(src, "%d|S|3\n%d|S|2\n", seq, seq+1)
+	if got, want := c.readLine(t), fmt.Sprintf("%d|S|2\n", seq+1); got != want {
+		t.Errorf("Client received %q, want %q", got, want)
+	}
+}
+
+func TestServerWALAppendFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := wal.Open(dir, wal.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions()
+	opts.NoReset = true
+	opts.WAL = l
+	s := startServer(t, opts)
+	defer s.stop(t)
+	c := dialClient(t, s.Server, 1)
+	defer c.Close()
+	waitStats(t, s.Server, func(st Stats) bool { return st.Clients == 1 })
+
+	// appends fail once log is closed
+	l.Close()
+	src, err := net.Dial("tcp", s.EventSourceAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	fmt.Fprint(src, "1|B\n")
+	src.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := src.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Event source read returned %v, want %v", err, io.EOF)
+	}
+	if n := s.Stats().Rejected[WALAppend]; n != 1 {
+		t.Errorf("Want 1 %s rejected event, have %d", WALAppend, n)
+	}
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if line, err := c.r.ReadString('\n'); err == nil {
+		t.Errorf("Client received %q of event that hasn't been logged", line)
+	}
+}
+
+func TestServerSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := testOptions()
+	opts.NoReset = true
+	opts.SnapshotFile = filepath.Join(dir, "graph.snap")
+	opts.AdminListenAddr = "127.0.0.1:0"
+	s := startServer(t, opts)
+	src, err := net.Dial("tcp", s.EventSourceAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(src, "1|F|1|2\n2|F|1|3\n3|U|1|3\n")
+	waitStats(t, s.Server, func(st Stats) bool { return st.Events == 3 })
+
+	resp, err := http.Post("http://"+s.AdminAddr().String()+"/snapshot", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("POST /snapshot returned status %d", resp.StatusCode)
+	}
+	snap, err := snapshot.ReadFile(opts.SnapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&snapshot.Snapshot{Seq: 4, Follows: []router.Follow{{FollowerID: 1, FollowedID: 2}}}); !reflect.DeepEqual(snap, want) {
+		t.Errorf("Snapshot %v, want %v", snap, want)
+	}
+
+	fmt.Fprint(src, "4|F|1|3\n5|K|2|1\n6|J|3|100\n")
+	waitStats(t, s.Server, func(st Stats) bool { return st.Events == 6 })
+	src.Close()
+	s.stop(t) // takes snapshot on shutdown
+
+	s = startServer(t, opts)
+	defer s.stop(t)
+	if seq := s.dispatcher.Seq(); seq != 7 {
+		t.Errorf("Dispatcher expects sequence %d after restore, want 7", seq)
+	}
+	if want := []router.Block{{BlockerID: 2, BlockedID: 1}}; !reflect.DeepEqual(s.router.Blocks(), want) {
+		t.Errorf("Restored blocks %v, want %v", s.router.Blocks(), want)
+	}
+	if want := []router.Membership{{UserID: 3, GroupID: 100}}; !reflect.DeepEqual(s.router.Memberships(), want) {
+		t.Errorf("Restored memberships %v, want %v", s.router.Memberships(), want)
+	}
+	follows := s.router.Follows()
+	sort.Slice(follows, func(i, j int) bool { return follows[i].FollowedID < follows[j].FollowedID })
+	if want := []router.Follow{{FollowerID: 1, FollowedID: 2}, {FollowerID: 1, FollowedID: 3}}; !reflect.DeepEqual(follows, want) {
+		t.Errorf("Restored follows %v, want %v", follows, want)
+	}
+}
+
+func TestReadHandshake(t *testing.T) {
+	for _, testCase := range []struct {
+		line    string
+		userID  int
+		lastSeq int64
+		resume  bool
+		err     bool
+	}{
+		{"12\n", 12, 0, false, false},
+		{"12", 12, 0, false, false},
+		{"12|345\r\n", 12, 345, true, false},
+		{"12|\n", 12, 0, false, true},
+		{"x|1\n", 0, 0, false, true},
+		{"\n", 0, 0, false, true},
+	} {
+		userID, lastSeq, resume, err := readHandshake(strings.NewReader(testCase.line))
+		if userID != testCase.userID || lastSeq != testCase.lastSeq || resume != testCase.resume || (err != nil) != testCase.err {
+			t.Errorf("readHandshake(%q) = %d, %d, %t, %v", testCase.line, userID, lastSeq, resume, err)
+		}
+	}
+}
+
+type deadLetterSpy []string
+
+func (d *deadLetterSpy) DeadLetter(source string, line []byte, err error) {
+	*d = append(*d, string(line))
+}
+
+func TestServerErrorPolicies(t *testing.T) {
+	opts := testOptions()
+	dl := &deadLetterSpy{}
+	opts.DeadLetter = dl
+	opts.ErrorPolicies = map[ErrorClass]ErrorPolicy{
+		BadFormat:    SkipSilently,
+		UnknownType:  SkipAndLog,
+		SeqDuplicate: DeadLetter,
+	}
+	s := startServer(t, opts)
+	defer s.stop(t)
+
+	c := dialClient(t, s.Server, 1)
+	defer c.Close()
+	waitStats(t, s.Server, func(st Stats) bool { return st.Clients == 1 })
+
+	src, err := net.Dial("tcp", s.EventSourceAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for _, e := range []string{"1|P|2|1\n", "garbage\n", "5|X\n", "3|P|4|1\n", "3|P|5|1\n", "2|P|3|1\n"} {
+		fmt.Fprint(src, e)
+	}
+	for _, want := range []string{"1|P|2|1\n", "2|P|3|1\n", "3|P|4|1\n"} {
+		if got := c.readLine(t); got != want {
+			t.Errorf("Client received %q, want %q", got, want)
+		}
+	}
+	st := s.Stats()
+	for class, want := range map[ErrorClass]int64{BadFormat: 1, UnknownType: 1, SeqDuplicate: 1, SeqTooSmall: 0} {
+		if st.Rejected[class] != want {
+			t.Errorf("Want %d %s rejected lines, have %d", want, class, st.Rejected[class])
+		}
+	}
+
+	// default policy disconnects event source
+	fmt.Fprint(src, "1|P|2|1\n")
+	src.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := src.Read(make([]byte, 1)); err == nil {
+		t.Error("Event source should be disconnected")
+	}
+	if want := []string{"garbage\n", "5|X\n", "3|P|5|1\n", "1|P|2|1\n"}; !reflect.DeepEqual([]string(*dl), want) {
+		t.Errorf("Dead letters %q, want %q", *dl, want)
+	}
+}
+
+func TestErrorPolicySet(t *testing.T) {
+	for _, p := range []ErrorPolicy{Disconnect, SkipAndLog, SkipSilently, DeadLetter} {
+		var have ErrorPolicy
+		if err := have.Set(p.String()); err != nil || have != p {
+			t.Errorf("Set(%q) = %v, policy %s", p.String(), err, have)
+		}
+	}
+	var p ErrorPolicy
+	if err := p.Set("ignore"); err == nil {
+		t.Error("Set should fail on unknown policy name")
+	}
+}
+
+func TestServerDenseGraphShards(t *testing.T) {
+	opts := testOptions()
+	opts.Graph = router.NewDenseGraph
+	opts.RouterShards = 2
+	if err := New(opts).Listen(); err != router.ErrDenseGraphShards {
+		t.Errorf("Listen() = %v, want %v", err, router.ErrDenseGraphShards)
+	}
+}
+
+func TestServerUnknownErrorClass(t *testing.T) {
+	s := New(testOptions())
+	for _, class := range []ErrorClass{-1, numErrorClasses} {
+		if err := s.SetErrorPolicy(class, SkipSilently); err != ErrUnknownErrorClass {
+			t.Errorf("SetErrorPolicy(%s) = %v, want %v", class, err, ErrUnknownErrorClass)
+		}
+		if p := s.ErrorPolicy(class); p != Disconnect {
+			t.Errorf("ErrorPolicy(%s) = %s, want %s", class, p, Disconnect)
+		}
+	}
+
+	opts := testOptions()
+	opts.ErrorPolicies = map[ErrorClass]ErrorPolicy{numErrorClasses: SkipSilently}
+	if err := New(opts).Listen(); err != ErrUnknownErrorClass {
+		t.Errorf("Listen() = %v, want %v", err, ErrUnknownErrorClass)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	opts := testOptions()
+	opts.AdminListenAddr = "127.0.0.1:0"
+	opts.FanoutWorkers = 2
+	s := startServer(t, opts)
+	defer s.stop(t)
+
+	c := dialClient(t, s.Server, 1)
+	defer c.Close()
+	waitStats(t, s.Server, func(st Stats) bool { return st.Clients == 1 })
+
+	src, err := net.Dial("tcp", s.EventSourceAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	fmt.Fprint(src, "1|P|2|1\n3|B\n")
+	waitStats(t, s.Server, func(st Stats) bool { return st.Events == 2 })
+
+	resp, err := http.Get("http://" + s.AdminAddr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"fmaze_clients 1\n",
+		"fmaze_users 1\n",
+		"fmaze_events_parsed_total{type=\"B\"} 1\n",
+		"fmaze_events_dispatched_total{type=\"P\"} 1\n",
+		"fmaze_dispatcher_seq 2\n",
+		"fmaze_dispatcher_buffered 1\n",
+		"fmaze_router_fanout_count 1\n",
+		"# TYPE fmaze_router_fanout_queued gauge\n",
+		"fmaze_event_source_connections_total 1\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Metrics should contain %q", want)
+		}
+	}
+}
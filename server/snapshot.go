@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/telendt/fmaze/snapshot"
+)
+
+// ErrNoSnapshotFile is returned by Snapshot method of Server
+// when Options.SnapshotFile is not set.
+var ErrNoSnapshotFile = errors.New("server: no snapshot file")
+
+// Snapshot writes follow graph, block relation, group memberships and the next
+// expected event sequence number to Options.SnapshotFile. Events are not dispatched only
+// while these are being copied. Write-ahead log segments older than
+// snapshot are removed.
+func (s *Server) Snapshot() error {
+	if s.opts.SnapshotFile == "" {
+		return ErrNoSnapshotFile
+	}
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	var snap snapshot.Snapshot
+	s.dispatcher.Do(func(seq int64) {
+		snap.Seq = seq
+		snap.Follows = s.router.Follows()
+		snap.Blocks = s.router.Blocks()
+		snap.Members = s.router.Memberships()
+	})
+	if err := snapshot.WriteFile(s.opts.SnapshotFile, &snap); err != nil {
+		return err
+	}
+	if s.opts.WAL != nil {
+		return s.opts.WAL.TruncateBefore(snap.Seq)
+	}
+	return nil
+}
+
+// loadSnapshot restores follow graph, block relation and group memberships
+// from Options.SnapshotFile (if it exists) and returns the next expected
+// event sequence number.
+func (s *Server) loadSnapshot() (seq int64, ok bool, err error) {
+	if s.opts.SnapshotFile == "" {
+		return 0, false, nil
+	}
+	snap, err := snapshot.ReadFile(s.opts.SnapshotFile)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	for _, f := range snap.Follows {
+		s.router.Follow(f.FollowerID, f.FollowedID)
+	}
+	for _, b := range snap.Blocks {
+		s.router.Block(b.BlockerID, b.BlockedID)
+	}
+	for _, m := range snap.Members {
+		s.router.Join(m.UserID, m.GroupID)
+	}
+	log.Printf("restored %d follows, %d blocks and %d memberships from snapshot, next sequence %d\n",
+		len(snap.Follows), len(snap.Blocks), len(snap.Members), snap.Seq)
+	return snap.Seq, true, nil
+}
+
+// removeSnapshot removes snapshot file, it must be called with s.snapshotMu locked.
+func (s *Server) removeSnapshot() {
+	if s.opts.SnapshotFile == "" {
+		return
+	}
+	if err := os.Remove(s.opts.SnapshotFile); err != nil && !os.IsNotExist(err) {
+		log.Printf("snapshot remove: %s\n", err.Error())
+	}
+}
+
+// snapshotLoop takes snapshots every Options.SnapshotInterval until shutdown.
+func (s *Server) snapshotLoop() {
+	t := time.NewTicker(s.opts.SnapshotInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.Snapshot(); err != nil {
+				log.Printf("snapshot: %s\n", err.Error())
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// serveSnapshot takes snapshot on POST requests.
+func (s *Server) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.Snapshot(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/telendt/fmaze/event"
+)
+
+// SourceStats holds statistics of a connected event source.
+type SourceStats struct {
+	// Name is the event source name (with Options.NamedSources).
+	Name string
+	// Addr is the event source remote address.
+	Addr string
+	// Connected is the time event source connected at.
+	Connected time.Time
+	// Events is the number of events accepted from event source.
+	Events int64
+	// Rejected is the number of event lines rejected from event source.
+	Rejected int64
+}
+
+// source is a connected event source.
+type source struct {
+	// accessed atomically
+	events, rejected int64
+
+	name       string
+	addr       string
+	conn       net.Conn
+	connected  time.Time
+	dispatcher *event.Dispatcher
+	feed       *feed // with Options.NamedSources
+}
+
+func (src *source) stats() SourceStats {
+	return SourceStats{
+		Name:      src.name,
+		Addr:      src.addr,
+		Connected: src.connected,
+		Events:    atomic.LoadInt64(&src.events),
+		Rejected:  atomic.LoadInt64(&src.rejected),
+	}
+}
+
+// sourceStats returns statistics of connected event sources
+// ordered by connection time.
+func (s *Server) sourceStats() []SourceStats {
+	s.mu.Lock()
+	stats := make([]SourceStats, 0, len(s.activeSources))
+	for src := range s.activeSources {
+		stats = append(stats, src.stats())
+	}
+	s.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Connected.Before(stats[j].Connected)
+	})
+	return stats
+}
+
+// serveSource reads events from conn. Internal state is reset
+// (unless disabled) once the last connected event source goes away.
+// With Options.NamedSources it's state built by the last connected
+// event source of the same name that is reset.
+func (s *Server) serveSource(conn net.Conn) {
+	r := bufio.NewReaderSize(conn, s.opts.ReadBufferSize)
+	src := &source{
+		addr:       conn.RemoteAddr().String(),
+		conn:       conn,
+		connected:  time.Now(),
+		dispatcher: s.dispatcher,
+	}
+	var startSeq int64
+	if s.opts.NamedSources {
+		conn.SetReadDeadline(time.Now().Add(s.opts.AuthTimeout))
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		if src.name, startSeq, err = parseSourceHandshake(line, s.opts.StartSequence); err != nil {
+			log.Printf("%s: %q\n", err.Error(), line)
+			return
+		}
+		conn.SetReadDeadline(nilTime)
+	}
+
+	s.sourcesMu.Lock()
+	if s.opts.NamedSources {
+		src.feed = s.joinFeed(src.name, startSeq)
+		src.dispatcher = src.feed.dispatcher
+	}
+	s.mu.Lock()
+	s.activeSources[src] = struct{}{}
+	s.mu.Unlock()
+	s.sourcesMu.Unlock()
+
+	s.handleEventSource(r, src)
+
+	// new sources wait for reset to finish
+	s.sourcesMu.Lock()
+	defer s.sourcesMu.Unlock()
+	s.mu.Lock()
+	delete(s.activeSources, src)
+	last := len(s.activeSources) == 0
+	s.mu.Unlock()
+	reset := !s.opts.NoReset && !s.closing()
+	if src.feed != nil {
+		s.leaveFeed(src.feed, reset)
+	} else if last && reset {
+		s.reset()
+	}
+}
+
+// reset resets internal state.
+func (s *Server) reset() {
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+	s.dispatcher.Reset()
+	s.router.Reset()
+	if s.opts.WAL != nil {
+		if err := s.opts.WAL.Reset(); err != nil {
+			log.Printf("wal reset: %s\n", err.Error())
+		}
+	}
+	s.removeSnapshot()
+	atomic.AddInt64(&s.stats.Resets, 1)
+}
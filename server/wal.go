@@ -0,0 +1,94 @@
+package server
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/telendt/fmaze/event"
+	"github.com/telendt/fmaze/router"
+)
+
+// walAppendError records failure to append event line to write-ahead log.
+type walAppendError struct {
+	err error
+}
+
+func (e *walAppendError) Error() string {
+	return "wal append: " + e.err.Error()
+}
+
+// loggedTrigger appends event line to write-ahead log
+// before its actions are triggered.
+type loggedTrigger struct {
+	s    *Server
+	src  *source
+	seq  int64
+	line []byte
+	event.ActionsTrigger
+}
+
+// Trigger triggers actions only of events appended to write-ahead log.
+// Event lines that fail to be appended are rejected, so that by default
+// their event source is disconnected.
+func (t loggedTrigger) Trigger(actions event.Actions) {
+	if err := t.s.opts.WAL.Append(t.seq, t.line); err != nil {
+		atomic.AddInt64(&t.src.rejected, 1)
+		if !t.s.reject(t.src, t.line, &walAppendError{err}) {
+			t.src.conn.Close()
+		}
+		return
+	}
+	t.ActionsTrigger.Trigger(actions)
+}
+
+// restoreActions applies only follow graph, block relation
+// and group membership changes of replayed events.
+type restoreActions struct {
+	*router.Router
+}
+
+func (restoreActions) SendMsg(int, int, []byte)          {}
+func (restoreActions) SendMsgToUsers(int, []int, []byte) {}
+func (restoreActions) SendMsgToFollowers(int, []byte)    {}
+func (restoreActions) SendMsgToGroup(int, int, []byte)   {}
+func (restoreActions) Broadcast([]byte)                  {}
+
+// restore restores follow graph, block relation and group memberships
+// from snapshot and write-ahead log (if configured) and makes dispatcher
+// expect the following event.
+func (s *Server) restore() error {
+	seq, ok, err := s.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	if s.opts.WAL != nil {
+		var (
+			n       int
+			actions = restoreActions{s.router}
+		)
+		err := s.opts.WAL.Replay(func(lseq int64, payload []byte) error {
+			if ok && lseq < seq {
+				// already in snapshot
+				return nil
+			}
+			e, err := event.Parse(payload)
+			if err != nil {
+				return err
+			}
+			e.Trigger(actions)
+			n++
+			seq, ok = lseq+1, true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("restored %d events from wal, next sequence %d\n", n, seq)
+		}
+	}
+	if ok {
+		s.dispatcher.ResetTo(seq)
+	}
+	return nil
+}
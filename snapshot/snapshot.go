@@ -0,0 +1,284 @@
+// Package snapshot stores follow graph, block relation, group memberships
+// and event sequence number in compact, versioned snapshot files.
+package snapshot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/telendt/fmaze/router"
+)
+
+// Snapshot file consists of:
+//
+//	magic    "FMZS"
+//	version  byte
+//	seq      varint
+//	n        uvarint (number of follows)
+//	follows  n follows sorted by follower and followed identifiers
+//	m        uvarint (number of blocks)
+//	blocks   m blocks sorted by blocker and blocked identifiers
+//	k        uvarint (number of group memberships)
+//	members  k memberships sorted by user and group identifiers
+//	crc      uint32 (CRC-32C of all the previous bytes, big-endian)
+//
+// where every pair of identifiers is encoded as a difference from
+// the previous one: first identifier difference (uvarint) and second
+// identifier (varint) or, for the same first identifier, second identifier
+// difference (uvarint). The first pair is encoded as if it followed (0, 0).
+const (
+	magic = "FMZS"
+
+	// Version is the current snapshot format version.
+	Version = 1
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrBadFormat is returned by Read when data is not a snapshot.
+	ErrBadFormat = errors.New("snapshot: bad format")
+
+	// ErrChecksum is returned by Read when snapshot checksum doesn't match.
+	ErrChecksum = errors.New("snapshot: checksum mismatch")
+)
+
+// UnsupportedVersionError records unsupported snapshot format version.
+type UnsupportedVersionError struct {
+	Version byte
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("snapshot: unsupported version %d", e.Version)
+}
+
+// Snapshot holds follow graph, block relation, group memberships
+// and sequence number of the next event to be applied to them.
+type Snapshot struct {
+	Seq     int64
+	Follows []router.Follow
+	Blocks  []router.Block
+	Members []router.Membership
+}
+
+// crcWriter computes checksum of written data.
+type crcWriter struct {
+	w   io.Writer
+	crc uint32
+	n   int64
+}
+
+func (w *crcWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.crc = crc32.Update(w.crc, crcTable, p[:n])
+	w.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes snapshot to w. It sorts s.Follows, s.Blocks
+// and s.Members in place.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	sort.Slice(s.Follows, func(i, j int) bool {
+		a, b := s.Follows[i], s.Follows[j]
+		return a.FollowerID < b.FollowerID ||
+			(a.FollowerID == b.FollowerID && a.FollowedID < b.FollowedID)
+	})
+	sort.Slice(s.Blocks, func(i, j int) bool {
+		a, b := s.Blocks[i], s.Blocks[j]
+		return a.BlockerID < b.BlockerID ||
+			(a.BlockerID == b.BlockerID && a.BlockedID < b.BlockedID)
+	})
+	sort.Slice(s.Members, func(i, j int) bool {
+		a, b := s.Members[i], s.Members[j]
+		return a.UserID < b.UserID ||
+			(a.UserID == b.UserID && a.GroupID < b.GroupID)
+	})
+
+	bw := bufio.NewWriter(w)
+	cw := &crcWriter{w: bw}
+	var buf [binary.MaxVarintLen64]byte
+	uvarint := func(v uint64) {
+		cw.Write(buf[:binary.PutUvarint(buf[:], v)])
+	}
+	varint := func(v int64) {
+		cw.Write(buf[:binary.PutVarint(buf[:], v)])
+	}
+	pairs := func(n int, pair func(i int) (a, b int)) {
+		uvarint(uint64(n))
+		var prevA, prevB int
+		for i := 0; i < n; i++ {
+			a, b := pair(i)
+			uvarint(uint64(a - prevA))
+			if a == prevA {
+				uvarint(uint64(b - prevB))
+			} else {
+				varint(int64(b))
+			}
+			prevA, prevB = a, b
+		}
+	}
+
+	cw.Write([]byte{magic[0], magic[1], magic[2], magic[3], Version})
+	varint(s.Seq)
+	pairs(len(s.Follows), func(i int) (int, int) {
+		return s.Follows[i].FollowerID, s.Follows[i].FollowedID
+	})
+	pairs(len(s.Blocks), func(i int) (int, int) {
+		return s.Blocks[i].BlockerID, s.Blocks[i].BlockedID
+	})
+	pairs(len(s.Members), func(i int) (int, int) {
+		return s.Members[i].UserID, s.Members[i].GroupID
+	})
+	binary.BigEndian.PutUint32(buf[:], cw.crc)
+	bw.Write(buf[:4])
+	return cw.n + 4, bw.Flush()
+}
+
+// crcReader computes checksum of read data.
+type crcReader struct {
+	r   *bufio.Reader
+	crc uint32
+}
+
+func (r *crcReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.crc = crc32.Update(r.crc, crcTable, []byte{b})
+	}
+	return b, err
+}
+
+// Read reads snapshot from r.
+func Read(r io.Reader) (*Snapshot, error) {
+	cr := &crcReader{r: bufio.NewReader(r)}
+	var header [len(magic) + 1]byte
+	for i := range header {
+		b, err := cr.ReadByte()
+		if err != nil {
+			return nil, ErrBadFormat
+		}
+		header[i] = b
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, ErrBadFormat
+	}
+	v := header[len(magic)]
+	if v != Version {
+		return nil, &UnsupportedVersionError{v}
+	}
+
+	s := &Snapshot{}
+	seq, err := binary.ReadVarint(cr)
+	if err != nil {
+		return nil, ErrBadFormat
+	}
+	s.Seq = seq
+	pairs := func(f func(a, b int)) error {
+		n, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return ErrBadFormat
+		}
+		var prevA, prevB int
+		for i := uint64(0); i < n; i++ {
+			d, err := binary.ReadUvarint(cr)
+			if err != nil {
+				return ErrBadFormat
+			}
+			a, b := prevA+int(d), 0
+			if d == 0 {
+				d, err = binary.ReadUvarint(cr)
+				b = prevB + int(d)
+			} else {
+				var v int64
+				v, err = binary.ReadVarint(cr)
+				b = int(v)
+			}
+			if err != nil {
+				return ErrBadFormat
+			}
+			f(a, b)
+			prevA, prevB = a, b
+		}
+		return nil
+	}
+	err = pairs(func(a, b int) {
+		s.Follows = append(s.Follows, router.Follow{FollowerID: a, FollowedID: b})
+	})
+	if err == nil {
+		err = pairs(func(a, b int) {
+			s.Blocks = append(s.Blocks, router.Block{BlockerID: a, BlockedID: b})
+		})
+	}
+	if err == nil {
+		err = pairs(func(a, b int) {
+			s.Members = append(s.Members, router.Membership{UserID: a, GroupID: b})
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sum [4]byte
+	if _, err := io.ReadFull(cr.r, sum[:]); err != nil {
+		return nil, ErrBadFormat
+	}
+	if binary.BigEndian.Uint32(sum[:]) != cr.crc {
+		return nil, ErrChecksum
+	}
+	return s, nil
+}
+
+// ReadFile reads snapshot from file at path.
+func ReadFile(path string) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// WriteFile atomically and durably replaces file at path with snapshot s.
+// It sorts s.Follows, s.Blocks and s.Members in place.
+func WriteFile(path string, s *Snapshot) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = s.WriteTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir commits directory entries of directory at path (like renames) to disk.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package snapshot
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/telendt/fmaze/router"
+)
+
+// follows returns follows of (follower, followed) identifier pairs.
+func follows(ids ...int) []router.Follow {
+	var fs []router.Follow
+	for i := 0; i+1 < len(ids); i += 2 {
+		fs = append(fs, router.Follow{FollowerID: ids[i], FollowedID: ids[i+1]})
+	}
+	return fs
+}
+
+// members returns memberships of (user, group) identifier pairs.
+func members(ids ...int) []router.Membership {
+	var ms []router.Membership
+	for i := 0; i+1 < len(ids); i += 2 {
+		ms = append(ms, router.Membership{UserID: ids[i], GroupID: ids[i+1]})
+	}
+	return ms
+}
+
+// blocks returns blocks of (blocker, blocked) identifier pairs.
+func blocks(ids ...int) []router.Block {
+	var bs []router.Block
+	for i := 0; i+1 < len(ids); i += 2 {
+		bs = append(bs, router.Block{BlockerID: ids[i], BlockedID: ids[i+1]})
+	}
+	return bs
+}
+
+func TestSnapshotReadWrite(t *testing.T) {
+	s := &Snapshot{
+		Seq:     1234,
+		Follows: follows(3, 1, 1, 2, 1, -7, -5, 1000000, 0, 0, 1, 100),
+		Blocks:  blocks(2, 1, -1, 3, 2, -4),
+		Members: members(1, 100, 1, 7, 2, 100),
+	}
+	var buf bytes.Buffer
+	n, err := s.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo returned error %s", err.Error())
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+	data := buf.Bytes()
+
+	have, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Read returned error %s", err.Error())
+	}
+	want := &Snapshot{
+		Seq:     1234,
+		Follows: follows(-5, 1000000, 0, 0, 1, -7, 1, 2, 1, 100, 3, 1),
+		Blocks:  blocks(-1, 3, 2, -4, 2, 1),
+		Members: members(1, 7, 1, 100, 2, 100),
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("Read returned %v, want %v", have, want)
+	}
+
+	for _, testCase := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrBadFormat},
+		{"truncated", data[:len(data)-1], ErrBadFormat},
+		{"bad magic", append([]byte("XXXX"), data[4:]...), ErrBadFormat},
+		{"corrupted", append(append([]byte{}, data[:6]...), append([]byte{data[6] ^ 1}, data[7:]...)...), ErrChecksum},
+	} {
+		if _, err := Read(bytes.NewReader(testCase.data)); err != testCase.err {
+			t.Errorf("%s: Read returned %v, want %v", testCase.name, err, testCase.err)
+		}
+	}
+	future := append([]byte{}, data...)
+	future[4] = Version + 1
+	if _, err := Read(bytes.NewReader(future)); !reflect.DeepEqual(err, &UnsupportedVersionError{Version + 1}) {
+		t.Errorf("Read of future version returned %v", err)
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "graph.snap")
+
+	for _, s := range []*Snapshot{
+		{Seq: 1, Follows: follows(1, 2), Blocks: blocks(2, 1), Members: members(1, 3)},
+		{Seq: 2}, // replaces the previous one
+	} {
+		if err := WriteFile(path, s); err != nil {
+			t.Fatalf("WriteFile returned error %s", err.Error())
+		}
+		have, err := ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile returned error %s", err.Error())
+		}
+		if !reflect.DeepEqual(have, s) {
+			t.Errorf("ReadFile returned %v, want %v", have, s)
+		}
+	}
+	if fis, _ := ioutil.ReadDir(dir); len(fis) != 1 {
+		t.Errorf("Temporary files left in %s", dir)
+	}
+}
@@ -0,0 +1,388 @@
+// Package wal implements a durable append-only log of ordered event lines.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every record is stored as:
+//
+//	length  uint32 (of payload)
+//	crc     uint32 (CRC-32C of seq and payload)
+//	seq     int64
+//	payload
+//
+// with all the integers in big-endian order.
+const headerSize = 16
+
+const segmentExt = ".wal"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrClosed is returned by Append when log has been closed.
+var ErrClosed = errors.New("wal: log closed")
+
+// CorruptError records corrupted (or truncated) record found by Replay.
+type CorruptError struct {
+	Segment string
+	Offset  int64
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("wal: corrupt record in %s at offset %d", e.Segment, e.Offset)
+}
+
+// SyncPolicy defines when appended records are synced to disk.
+type SyncPolicy int
+
+// Sync policies.
+const (
+	// SyncInterval syncs appended records every Options.SyncInterval.
+	SyncInterval SyncPolicy = iota
+	// SyncAlways syncs every appended record before Append returns.
+	SyncAlways
+	// SyncNever leaves syncing to the operating system.
+	SyncNever
+)
+
+var syncPolicyNames = [...]string{
+	SyncInterval: "interval",
+	SyncAlways:   "always",
+	SyncNever:    "never",
+}
+
+func (p SyncPolicy) String() string {
+	if p >= 0 && int(p) < len(syncPolicyNames) {
+		return syncPolicyNames[p]
+	}
+	return "SyncPolicy(" + strconv.Itoa(int(p)) + ")"
+}
+
+// Set sets policy from its name, so that *SyncPolicy implements flag.Value.
+func (p *SyncPolicy) Set(name string) error {
+	for i, n := range syncPolicyNames {
+		if n == name {
+			*p = SyncPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown sync policy %q", name)
+}
+
+// Options configure Log.
+type Options struct {
+	// SegmentSize is the size in bytes after which a new segment file
+	// is started (0 means no limit).
+	SegmentSize int64
+
+	// Sync defines when appended records are synced to disk.
+	Sync SyncPolicy
+
+	// SyncInterval is the sync period of SyncInterval policy.
+	SyncInterval time.Duration
+}
+
+// DefaultOptions holds default log options.
+var DefaultOptions = Options{
+	SegmentSize:  64 << 20,
+	Sync:         SyncInterval,
+	SyncInterval: time.Second,
+}
+
+// Log is an append-only log of event lines stored in segment files
+// of a single directory. Segment files are named after sequence number
+// of their first record. Log is safe for concurrent use.
+type Log struct {
+	mu     sync.Mutex
+	dir    string
+	opts   Options
+	f      *os.File // current segment
+	size   int64    // of current segment
+	buf    []byte
+	dirty  bool
+	closed bool
+
+	stop, stopped chan struct{}
+}
+
+// Open opens log stored in dir, creating the directory if needed.
+// New records are always appended to a new segment.
+func Open(dir string, opts Options) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &Log{
+		dir:  dir,
+		opts: opts,
+	}
+	if opts.Sync == SyncInterval && opts.SyncInterval > 0 {
+		l.stop = make(chan struct{})
+		l.stopped = make(chan struct{})
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+func (l *Log) syncLoop() {
+	defer close(l.stopped)
+	t := time.NewTicker(l.opts.SyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := l.Sync(); err != nil {
+				log.Printf("wal: %s\n", err.Error())
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+type segment struct {
+	name     string
+	firstSeq int64
+}
+
+// segments returns segment files sorted by sequence number of their first record.
+func (l *Log) segments() ([]segment, error) {
+	fis, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []segment
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, segment{name, seq})
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].firstSeq < segs[j].firstSeq
+	})
+	return segs, nil
+}
+
+// Replay calls f with every logged record in order. It stops at the first
+// error returned by f and returns it. Corrupted (or partially written) records
+// at the end of the last segment are truncated as these are left by crashes
+// during Append, corrupted records found anywhere else are reported with
+// CorruptError. Replay should be called before the first Append.
+func (l *Log) Replay(f func(seq int64, payload []byte) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segs, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for i, seg := range segs {
+		path := filepath.Join(l.dir, seg.name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var off int64
+		for len(data) > 0 {
+			seq, payload, ok := decode(data)
+			if !ok {
+				if i < len(segs)-1 {
+					return &CorruptError{seg.name, off}
+				}
+				log.Printf("wal: truncating %s at offset %d\n", seg.name, off)
+				if err := os.Truncate(path, off); err != nil {
+					return err
+				}
+				break
+			}
+			if err := f(seq, payload); err != nil {
+				return err
+			}
+			n := headerSize + len(payload)
+			data = data[n:]
+			off += int64(n)
+		}
+	}
+	return nil
+}
+
+// decode decodes the first record in data, ok is false if it's corrupted.
+func decode(data []byte) (seq int64, payload []byte, ok bool) {
+	if len(data) < headerSize {
+		return 0, nil, false
+	}
+	n := binary.BigEndian.Uint32(data[0:])
+	if uint64(n) > uint64(len(data)-headerSize) {
+		return 0, nil, false
+	}
+	sum := binary.BigEndian.Uint32(data[4:])
+	rec := data[8 : headerSize+int(n)]
+	if crc32.Checksum(rec, crcTable) != sum {
+		return 0, nil, false
+	}
+	return int64(binary.BigEndian.Uint64(rec)), rec[8:], true
+}
+
+// Append appends event line payload with sequence number seq to the log.
+func (l *Log) Append(seq int64, payload []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if l.f == nil || (l.opts.SegmentSize > 0 && l.size >= l.opts.SegmentSize) {
+		if err := l.rotate(seq); err != nil {
+			return err
+		}
+	}
+
+	n := headerSize + len(payload)
+	if cap(l.buf) < n {
+		l.buf = make([]byte, n)
+	}
+	rec := l.buf[:n]
+	binary.BigEndian.PutUint32(rec[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint64(rec[8:], uint64(seq))
+	copy(rec[headerSize:], payload)
+	binary.BigEndian.PutUint32(rec[4:], crc32.Checksum(rec[8:], crcTable))
+
+	written, err := l.f.Write(rec)
+	l.size += int64(written)
+	if err != nil {
+		return err
+	}
+	if l.opts.Sync == SyncAlways {
+		return l.f.Sync()
+	}
+	l.dirty = true
+	return nil
+}
+
+// rotate closes current segment and starts a new one with record seq.
+func (l *Log) rotate(seq int64) error {
+	if err := l.closeSegment(); err != nil {
+		return err
+	}
+	name := filepath.Join(l.dir, strconv.FormatInt(seq, 10)+segmentExt)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if l.opts.Sync != SyncNever {
+		if err := syncDir(l.dir); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	l.f = f
+	l.size = 0
+	return nil
+}
+
+func (l *Log) closeSegment() error {
+	if l.f == nil {
+		return nil
+	}
+	err := l.sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Sync syncs appended records to disk.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sync()
+}
+
+func (l *Log) sync() error {
+	if l.f == nil || !l.dirty || l.opts.Sync == SyncNever {
+		return nil
+	}
+	l.dirty = false
+	return l.f.Sync()
+}
+
+// Reset removes all the logged records.
+func (l *Log) Reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.closeSegment(); err != nil {
+		return err
+	}
+	segs, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for _, seg := range segs {
+		if err := os.Remove(filepath.Join(l.dir, seg.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TruncateBefore removes segments holding only records
+// with sequence numbers smaller than seq.
+func (l *Log) TruncateBefore(seq int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segs, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(segs) && segs[i+1].firstSeq <= seq; i++ {
+		if err := os.Remove(filepath.Join(l.dir, segs[i].name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close syncs and closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	err := l.closeSegment()
+	l.mu.Unlock()
+	if l.stop != nil {
+		close(l.stop)
+		<-l.stopped
+	}
+	return err
+}
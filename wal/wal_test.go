@@ -0,0 +1,117 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type record struct {
+	seq     int64
+	payload string
+}
+
+func replay(t *testing.T, l *Log) []record {
+	var recs []record
+	if err := l.Replay(func(seq int64, payload []byte) error {
+		recs = append(recs, record{seq, string(payload)})
+		return nil
+	}); err != nil {
+		t.Fatalf("Replay returned error %s", err.Error())
+	}
+	return recs
+}
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{SegmentSize: 40, Sync: SyncAlways}
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []record
+	for seq := int64(1); seq <= 5; seq++ {
+		payload := fmt.Sprintf("%d|B\n", seq)
+		if err := l.Append(seq, []byte(payload)); err != nil {
+			t.Fatalf("Append returned error %s", err.Error())
+		}
+		want = append(want, record{seq, payload})
+	}
+	l.Close()
+	if err := l.Append(6, []byte("6|B\n")); err != ErrClosed {
+		t.Errorf("Append on closed log returned %v, want %v", err, ErrClosed)
+	}
+
+	// 2 records per segment
+	for _, name := range []string{"1.wal", "3.wal", "5.wal"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Segment %s not found: %s", name, err.Error())
+		}
+	}
+
+	// simulate partial write of the last record
+	f, err := os.OpenFile(filepath.Join(dir, "5.wal"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 4, 1, 2})
+	f.Close()
+
+	l, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := replay(t, l); !reflect.DeepEqual(have, want) {
+		t.Errorf("Replay returned %v, want %v", have, want)
+	}
+	l.Append(6, []byte("6|B\n"))
+	want = append(want, record{6, "6|B\n"})
+	if have := replay(t, l); !reflect.DeepEqual(have, want) {
+		t.Errorf("Replay after reopen returned %v, want %v", have, want)
+	}
+
+	// corrupt the first segment
+	path := filepath.Join(dir, "1.wal")
+	b, _ := ioutil.ReadFile(path)
+	b[len(b)-2] = 'X'
+	ioutil.WriteFile(path, b, 0644)
+	err = l.Replay(func(int64, []byte) error { return nil })
+	if cerr, ok := err.(*CorruptError); !ok || cerr.Segment != "1.wal" || cerr.Offset != 20 {
+		t.Errorf("Replay of corrupted log returned %v", err)
+	}
+
+	if err := l.TruncateBefore(4); err != nil {
+		t.Fatalf("TruncateBefore returned error %s", err.Error())
+	}
+	if have := replay(t, l); !reflect.DeepEqual(have, want[2:]) {
+		t.Errorf("Replay after TruncateBefore(4) returned %v, want %v", have, want[2:])
+	}
+
+	if err := l.Reset(); err != nil {
+		t.Fatalf("Reset returned error %s", err.Error())
+	}
+	if have := replay(t, l); have != nil {
+		t.Errorf("Replay after Reset returned %v", have)
+	}
+	l.Close()
+}
+
+func TestSyncPolicySet(t *testing.T) {
+	var p SyncPolicy
+	for _, want := range []SyncPolicy{SyncAlways, SyncNever, SyncInterval} {
+		if err := p.Set(want.String()); err != nil || p != want {
+			t.Errorf("Set(%q) = %v, policy %s", want.String(), err, p)
+		}
+	}
+	if err := p.Set("sometimes"); err == nil {
+		t.Error("Set should fail for unknown policy")
+	}
+}